@@ -0,0 +1,102 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// Run with '-cpu 1,2,4,8' to see how the readers scale with the cores, e.g.
+//   go test -run NONE -bench . -cpu 1,2,4,8
+
+const benchKeys = 100000
+
+func openBenchDB(b *testing.B) (*RabbitKV, func()) {
+	dir, err := ioutil.TempDir("", "rabbitkv-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	rkv, err := CreateRabbitKV(dir, &Options{GCInterval: -1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	batch := rkv.NewBatch()
+	for i := 0; i < benchKeys; i++ {
+		batch.Set(benchKey(i), []byte(fmt.Sprintf("value%d", i)))
+	}
+	if err = batch.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return rkv, func() {
+		rkv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+func benchmarkGet(b *testing.B, rkv *RabbitKV) {
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			if _, err := rkv.Get(benchKey(rnd.Intn(benchKeys))); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	rkv, cleanup := openBenchDB(b)
+	defer cleanup()
+	benchmarkGet(b, rkv)
+}
+
+// The readers run while a writer keeps updating and inserting keys
+func BenchmarkGetWhileWriting(b *testing.B) {
+	rkv, cleanup := openBenchDB(b)
+	defer cleanup()
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := rkv.Set(benchKey(i%(2*benchKeys)), []byte("updated")); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	benchmarkGet(b, rkv)
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func BenchmarkSet(b *testing.B) {
+	rkv, cleanup := openBenchDB(b)
+	defer cleanup()
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&n, 1)
+			if err := rkv.Set(benchKey(int(i)%benchKeys), []byte("updated")); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
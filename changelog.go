@@ -0,0 +1,311 @@
+package rabbitkv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/mmcloughlin/meow"
+)
+
+// Change is a write made by a committed batch. A nil Value means the key is deleted
+type Change struct {
+	Seq   uint64
+	Key   []byte
+	Value []byte
+}
+
+// The change log records the writes of each committed batch, such that they can be replayed
+// elsewhere. A record is written before the batch is committed in the index log, and flushed
+// before the index log. The records of the uncommitted batches are removed by recovery. Each
+// file is named by the sequence number of its first record. A record is encoded as:
+// [length uint32][seq uint64][count uint32]([op byte][len uint32][key]([len uint32][value]))*[cksum]
+// where length counts the bytes after itself, and op is 1 for setting and 0 for deleting
+type changeLogger struct {
+	dirName     string
+	seqMtx      sync.Mutex // guards fileSeqs, which is read by the subscriptions without 'wmtx'
+	fileSeqs    []uint64   // the first sequence numbers of the files, in increasing order
+	outFile     *os.File
+	maxFileSize int64
+	retained    int
+}
+
+func changeLogFileName(dirName string, seq uint64) string {
+	return filepath.Join(dirName, fmt.Sprintf("%d", seq))
+}
+
+// Open the change log in dirName, creating the directory and the first file if needed,
+// whose first record should be 'nextSeq'
+func openChangeLogger(dirName string, nextSeq uint64, opts *Options) (*changeLogger, error) {
+	cl := &changeLogger{
+		dirName:     dirName,
+		maxFileSize: opts.ChangeLogFileSize,
+		retained:    opts.RetainedChangeLogFiles,
+	}
+	if err := os.MkdirAll(dirName, 0700); err != nil {
+		return nil, err
+	}
+	fileInfoList, err := ioutil.ReadDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	for _, fileInfo := range fileInfoList {
+		seq, err := strconv.ParseUint(fileInfo.Name(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cl.fileSeqs = append(cl.fileSeqs, seq)
+	}
+	sort.Slice(cl.fileSeqs, func(i, j int) bool {
+		return cl.fileSeqs[i] < cl.fileSeqs[j]
+	})
+	if len(cl.fileSeqs) == 0 {
+		cl.fileSeqs = append(cl.fileSeqs, nextSeq)
+	}
+	last := cl.fileSeqs[len(cl.fileSeqs)-1]
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	cl.outFile, err = os.OpenFile(changeLogFileName(dirName, last), flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func encodeChangeRecord(seq uint64, cache map[string][]byte) []byte {
+	keys := make([]string, 0, len(cache))
+	for k := range cache {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := make([]byte, 16, 64)
+	binary.LittleEndian.PutUint64(buf[4:12], seq)
+	binary.LittleEndian.PutUint32(buf[12:16], uint32(len(keys)))
+	var lenBuf [4]byte
+	for _, k := range keys {
+		v := cache[k]
+		if v == nil {
+			buf = append(buf, 0)
+		} else {
+			buf = append(buf, 1)
+		}
+		binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(k)))
+		buf = append(append(buf, lenBuf[:]...), k...)
+		if v != nil {
+			binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(v)))
+			buf = append(append(buf, lenBuf[:]...), v...)
+		}
+	}
+	binary.LittleEndian.PutUint32(lenBuf[:], meow.Checksum32(0, buf[4:]))
+	buf = append(buf, lenBuf[:]...)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	return buf
+}
+
+// Read the record at 'off' and return its sequence number, changes and total length.
+// io.ErrUnexpectedEOF is returned if the record is incomplete and io.EOF if there is no record
+func readChangeRecord(f *os.File, off int64) (uint64, []Change, int64, error) {
+	var lenBuf [4]byte
+	n, err := f.ReadAt(lenBuf[:], off)
+	if n == 0 && err == io.EOF {
+		return 0, nil, 0, io.EOF
+	} else if n < 4 {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	length := int64(binary.LittleEndian.Uint32(lenBuf[:]))
+	if length < 16 {
+		return 0, nil, 0, fmt.Errorf("%w: invalid length %d at %d of %s", ErrCorruptChangeLog, length, off, f.Name())
+	}
+	bz := make([]byte, length)
+	n, err = f.ReadAt(bz, off+4)
+	if int64(n) < length {
+		if err == io.EOF {
+			return 0, nil, 0, io.ErrUnexpectedEOF
+		}
+		return 0, nil, 0, err
+	}
+	body := bz[:length-4]
+	if meow.Checksum32(0, body) != binary.LittleEndian.Uint32(bz[length-4:]) {
+		return 0, nil, 0, fmt.Errorf("%w: checksum error at %d of %s", ErrCorruptChangeLog, off, f.Name())
+	}
+	seq := binary.LittleEndian.Uint64(body[0:8])
+	changes, err := decodeChanges(seq, body[8:])
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("%w at %d of %s", err, off, f.Name())
+	}
+	return seq, changes, length + 4, nil
+}
+
+func decodeChanges(seq uint64, body []byte) ([]Change, error) {
+	count := binary.LittleEndian.Uint32(body[0:4])
+	body = body[4:]
+	// read a length-prefixed byte string
+	next := func() ([]byte, bool) {
+		if len(body) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(body[:4])
+		if uint64(len(body)-4) < uint64(n) {
+			return nil, false
+		}
+		res := body[4 : 4+n]
+		body = body[4+n:]
+		return res, true
+	}
+	changes := make([]Change, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(body) == 0 {
+			return nil, fmt.Errorf("%w: too few changes", ErrCorruptChangeLog)
+		}
+		op := body[0]
+		body = body[1:]
+		c := Change{Seq: seq}
+		var ok bool
+		if c.Key, ok = next(); !ok {
+			return nil, fmt.Errorf("%w: invalid key", ErrCorruptChangeLog)
+		}
+		if op == 1 {
+			if c.Value, ok = next(); !ok {
+				return nil, fmt.Errorf("%w: invalid value", ErrCorruptChangeLog)
+			}
+			c.Value = append([]byte{}, c.Value...) // not nil even if empty
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// Append the record of the batch 'seq', a new file is started if the latest one is too large
+func (cl *changeLogger) append(seq uint64, cache map[string][]byte) error {
+	size, err := getFileSize(cl.outFile)
+	if err != nil {
+		return err
+	}
+	if size >= cl.maxFileSize {
+		if err = cl.addNewFile(seq); err != nil {
+			return err
+		}
+	}
+	_, err = cl.outFile.Write(encodeChangeRecord(seq, cache))
+	return err
+}
+
+func (cl *changeLogger) addNewFile(seq uint64) error {
+	// flush it because only the latest file is flushed by sync
+	if err := cl.outFile.Sync(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(changeLogFileName(cl.dirName, seq), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	cl.outFile.Close()
+	cl.outFile = f
+	cl.seqMtx.Lock()
+	defer cl.seqMtx.Unlock()
+	cl.fileSeqs = append(cl.fileSeqs, seq)
+	if cl.retained <= 0 {
+		return nil
+	}
+	for len(cl.fileSeqs) > cl.retained {
+		if err = os.Remove(changeLogFileName(cl.dirName, cl.fileSeqs[0])); err != nil {
+			return err
+		}
+		cl.fileSeqs = cl.fileSeqs[1:]
+	}
+	return nil
+}
+
+// Return a copy of fileSeqs
+func (cl *changeLogger) seqs() []uint64 {
+	cl.seqMtx.Lock()
+	defer cl.seqMtx.Unlock()
+	return append([]uint64{}, cl.fileSeqs...)
+}
+
+// Truncate the latest file to remove the incomplete records and the ones of the batches
+// which are not committed, i.e., whose sequence numbers are larger than 'lastSeq'. The records
+// are flushed before the batches are committed in the index log, so ErrCorruptChangeLog is
+// returned if the record of a committed batch is missing at the end
+func (cl *changeLogger) recoverTail(lastSeq uint64) error {
+	off, prevSeq := int64(0), uint64(0)
+	for {
+		seq, _, length, err := readChangeRecord(cl.outFile, off)
+		if err != nil || seq > lastSeq {
+			break // EOF, incomplete, corrupt or uncommitted
+		}
+		off, prevSeq = off+length, seq
+	}
+	size, err := getFileSize(cl.outFile)
+	if err != nil {
+		return err
+	}
+	if off != size {
+		if err = cl.outFile.Truncate(off); err != nil {
+			return err
+		}
+	}
+	last := len(cl.fileSeqs) - 1
+	if off == 0 && cl.fileSeqs[last] > lastSeq+1 { // started for an uncommitted batch
+		if err = os.Remove(cl.outFile.Name()); err != nil {
+			return err
+		}
+		cl.seqMtx.Lock()
+		cl.fileSeqs = cl.fileSeqs[:last]
+		cl.seqMtx.Unlock()
+		return cl.addNewFile(lastSeq + 1)
+	}
+	missing := cl.fileSeqs[last] // the first record expected in this file
+	if off != 0 {
+		missing = prevSeq + 1
+	}
+	if missing <= lastSeq {
+		return fmt.Errorf("%w: the records of batches %d to %d are missing in %s",
+			ErrCorruptChangeLog, missing, lastSeq, cl.outFile.Name())
+	}
+	return nil
+}
+
+func (cl *changeLogger) sync() error {
+	return cl.outFile.Sync()
+}
+
+func (cl *changeLogger) close() error {
+	return cl.outFile.Close()
+}
+
+func changeLogExists(dirName string) (bool, error) {
+	if dirName == "" {
+		return false, nil // not in the layout of LoadRabbitKV
+	}
+	_, err := os.Stat(dirName)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Open the change log after the index log is replayed, when the last sequence number is known
+func (rkv *RabbitKV) openChangeLog(dirName string) (err error) {
+	rkv.changes, err = openChangeLogger(dirName, rkv.mi.lastBatchSeq+1, rkv.opts)
+	if err != nil {
+		return
+	}
+	if !rkv.opts.ReadOnly {
+		err = rkv.changes.recoverTail(rkv.mi.lastBatchSeq)
+	}
+	if err != nil {
+		rkv.changes.close()
+		return
+	}
+	rkv.changeNotify = make(chan struct{})
+	return
+}
@@ -0,0 +1,138 @@
+package rabbitkv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nextChanges(t *testing.T, sub *Subscription) (res []string) {
+	changes, err := sub.Next()
+	require.NoError(t, err)
+	for _, c := range changes {
+		if c.Value == nil {
+			res = append(res, fmt.Sprintf("%d:%s-", c.Seq, c.Key))
+		} else {
+			res = append(res, fmt.Sprintf("%d:%s=%s", c.Seq, c.Key, c.Value))
+		}
+	}
+	return
+}
+
+func TestChangeLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1, ChangeLog: true, ChangeLogFileSize: 100}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	sub, err := rkv.Subscribe(0)
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("a"), []byte("1")))
+	batch := rkv.NewBatch()
+	require.NoError(t, batch.Set([]byte("c"), []byte("3")))
+	require.NoError(t, batch.Set([]byte("b"), []byte("")))
+	batch.Delete([]byte("a"))
+	require.NoError(t, batch.Close())
+	assert.Equal(t, []string{"1:a=1"}, nextChanges(t, sub))
+	assert.Equal(t, []string{"2:a-", "2:b=", "2:c=3"}, nextChanges(t, sub))
+
+	// Next waits for the next commit
+	result := make(chan []string)
+	go func() {
+		result <- nextChanges(t, sub)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, rkv.Delete([]byte("c")))
+	assert.Equal(t, []string{"3:c-"}, <-result)
+
+	for i := 4; i <= 50; i++ {
+		require.NoError(t, rkv.Set([]byte("k"), []byte(fmt.Sprint(i))))
+	}
+	assert.True(t, len(rkv.changes.fileSeqs) > 10)
+	for i := 4; i <= 50; i++ {
+		assert.Equal(t, []string{fmt.Sprintf("%d:k=%d", i, i)}, nextChanges(t, sub))
+	}
+	sub2, err := rkv.Subscribe(30)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"30:k=30"}, nextChanges(t, sub2))
+	require.NoError(t, sub2.Close())
+	_, err = sub2.Next()
+	assert.Equal(t, ErrClosed, err)
+
+	// the record of an uncommitted batch is removed by recovery
+	require.NoError(t, rkv.changes.append(51, map[string][]byte{"x": []byte("lost")}))
+	crash(rkv)
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("x"), []byte("kept")))
+	sub, err = rkv.Subscribe(50)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"50:k=50"}, nextChanges(t, sub))
+	assert.Equal(t, []string{"51:x=kept"}, nextChanges(t, sub))
+	require.NoError(t, rkv.Close())
+
+	// the old files are removed
+	opts.RetainedChangeLogFiles = 5
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("y"), []byte("2")))
+	sub, err = rkv.Subscribe(51)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"51:x=kept"}, nextChanges(t, sub))
+	assert.Equal(t, []string{"52:y=2"}, nextChanges(t, sub))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, rkv.Set([]byte("z"), []byte("0")))
+	}
+	assert.Equal(t, 5, len(rkv.changes.fileSeqs))
+	_, err = rkv.Subscribe(1)
+	assert.Equal(t, ErrChangeUnavailable, err)
+
+	sub, err = rkv.Subscribe(rkv.LatestVersion() + 1)
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rkv.Close()
+	}()
+	for err == nil {
+		_, err = sub.Next()
+	}
+	assert.Equal(t, ErrClosed, err)
+
+	// the batches cannot be committed with the change log disabled, which would be missing in it
+	_, err = Open(dir, &Options{GCInterval: -1})
+	assert.Equal(t, ErrChangeLogRequired, err)
+	rkv, err = Open(dir, &Options{GCInterval: -1, ReadOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, "2", getString(t, rkv, "y"))
+	require.NoError(t, rkv.Close())
+}
+
+func TestLostChangeRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1, ChangeLog: true}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("a"), []byte("1")))
+	require.NoError(t, rkv.Sync())
+	size, err := getFileSize(rkv.changes.outFile)
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("b"), []byte("2")))
+	require.NoError(t, rkv.Sync())
+	fname := rkv.changes.outFile.Name()
+	crash(rkv)
+	rkv.changes.close()
+
+	// a committed batch whose record is lost is reported, instead of being skipped silently
+	require.NoError(t, os.Truncate(fname, size))
+	_, err = Open(dir, opts)
+	assert.True(t, errors.Is(err, ErrCorruptChangeLog))
+	assert.Contains(t, err.Error(), "the records of batches 2 to 2 are missing")
+}
@@ -0,0 +1,171 @@
+package rabbitkv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A prefix of 'src' to be copied to 'dst'
+type fileCopy struct {
+	src  *os.File
+	dst  string
+	size int64
+}
+
+// Write a consistent copy of this RabbitKV into 'dstDir', which can be opened by Open. The
+// immutable files (the HPFile blocks, index-log files and change-log files except the latest
+// ones) are hard-linked when possible, and the others are copied. Writers are blocked only
+// while the files are linked and the ones to be copied are opened
+func (rkv *RabbitKV) Checkpoint(dstDir string) error {
+	layout := newDirLayout(dstDir)
+	if _, err := os.Stat(layout.metaFile); err == nil {
+		return errors.New("RabbitKV already exists in " + dstDir)
+	}
+	dirs := []string{layout.hpfDirName, layout.idxDirName}
+	if rkv.changes != nil {
+		dirs = append(dirs, layout.clDirName)
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return err
+		}
+	}
+
+	rkv.wmtx.Lock()
+	rkv.mtx.RLock()
+	copies, mi, err := rkv.linkForCheckpoint(layout)
+	rkv.mtx.RUnlock()
+	rkv.wmtx.Unlock()
+	defer func() {
+		for _, c := range copies {
+			c.src.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	for _, c := range copies {
+		if err = copyFilePrefix(c.src, c.dst, c.size); err != nil {
+			return err
+		}
+	}
+	for _, d := range dirs {
+		if err = syncFile(d); err != nil { // flush the directory entries of the new files
+			return err
+		}
+	}
+	// the meta file is written at last, such that an incomplete checkpoint cannot be opened
+	mi.closed = true
+	return writeMetaFile(layout.metaFile, &mi, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+}
+
+// Link the immutable files into 'layout' and open the other ones to be copied, 'wmtx' must be
+// locked and 'mtx' must be read-locked. The returned MetaInfo matches the current content of the files
+func (rkv *RabbitKV) linkForCheckpoint(layout dirLayout) (copies []fileCopy, mi MetaInfo, err error) {
+	if rkv.isClosed {
+		return nil, mi, ErrClosed
+	}
+	if rkv.writeErr != nil {
+		return nil, mi, rkv.writeErr
+	}
+	mi = rkv.mi
+	mi.allAddrBits = rkv.hb.GetAllAddrBits()
+
+	add := func(src, dst string, size int64) error {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		copies = append(copies, fileCopy{src: f, dst: dst, size: size})
+		return nil
+	}
+	// link a file or copy the whole of it if linking fails, e.g., across file systems
+	linkOrAdd := func(src, dst string) error {
+		if os.Link(src, dst) == nil {
+			return syncFile(dst)
+		}
+		info, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		return add(src, dst, info.Size())
+	}
+
+	for id, f := range rkv.hpfile.fileMap {
+		dst := filepath.Join(layout.hpfDirName, filepath.Base(f.Name()))
+		if id == rkv.hpfile.largestID {
+			err = add(f.Name(), dst, rkv.hpfile.latestSize)
+		} else {
+			err = linkOrAdd(f.Name(), dst)
+		}
+		if err != nil {
+			return
+		}
+	}
+	for i, id := range rkv.ilog.fileIDList {
+		name := fmt.Sprintf("%d", id)
+		src, dst := filepath.Join(rkv.ilog.dirName, name), filepath.Join(layout.idxDirName, name)
+		if i == len(rkv.ilog.fileIDList)-1 {
+			var size int64
+			if size, err = rkv.ilog.SizeOfLastFile(); err == nil {
+				err = add(src, dst, size)
+			}
+		} else {
+			err = linkOrAdd(src, dst)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if rkv.changes == nil {
+		return
+	}
+	// the latest change-log file ends with the record of lastBatchSeq, because 'wmtx' is locked
+	for i, seq := range rkv.changes.fileSeqs {
+		src := changeLogFileName(rkv.changes.dirName, seq)
+		dst := changeLogFileName(layout.clDirName, seq)
+		if i == len(rkv.changes.fileSeqs)-1 {
+			var size int64
+			if size, err = getFileSize(rkv.changes.outFile); err == nil {
+				err = add(src, dst, size)
+			}
+		} else {
+			err = linkOrAdd(src, dst)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Copy the first 'size' bytes of 'src' into a new file 'dst' and flush it
+func copyFilePrefix(src *os.File, dst string, size int64) error {
+	f, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(src, 0, size))
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func syncFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	overwrite(t, rkv, 20)
+	for rkv.gcNeeded() {
+		require.NoError(t, rkv.CollectGarbage())
+	}
+	require.True(t, rkv.hpfile.StartPos() > 0)
+	require.NoError(t, rkv.Checkpoint(dst))
+	assert.Error(t, rkv.Checkpoint(dst))
+	// the checkpoint is not affected by the following writes
+	overwrite(t, rkv, 21)
+
+	// the immutable blocks are linked
+	id := rkv.hpfile.StartPos() / 4096
+	name := fmt.Sprintf("%d-4096", id)
+	srcInfo, err := os.Stat(filepath.Join(dir, HPFileDirName, name))
+	require.NoError(t, err)
+	dstInfo, err := os.Stat(filepath.Join(dst, HPFileDirName, name))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+
+	cp, err := Open(dst, opts)
+	require.NoError(t, err)
+	checkOverwritten(t, cp, 20)
+	require.NoError(t, cp.Set([]byte("new"), []byte("v")))
+	require.NoError(t, cp.Close())
+	checkOverwritten(t, rkv, 21)
+	assert.Equal(t, "", getString(t, rkv, "new"))
+	require.NoError(t, rkv.Close())
+	assert.Equal(t, ErrClosed, rkv.Checkpoint(filepath.Join(dst, "x")))
+}
+
+func TestCheckpointChangeLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1, ChangeLog: true, ChangeLogFileSize: 100}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	for i := 1; i <= 20; i++ {
+		require.NoError(t, rkv.Set([]byte("k"), []byte(fmt.Sprint(i))))
+	}
+	require.NoError(t, rkv.Checkpoint(dst))
+	require.NoError(t, rkv.Set([]byte("k"), []byte("src")))
+
+	// the older change-log files are linked
+	name := fmt.Sprint(rkv.changes.fileSeqs[0])
+	srcInfo, err := os.Stat(filepath.Join(dir, ChangeLogDirName, name))
+	require.NoError(t, err)
+	dstInfo, err := os.Stat(filepath.Join(dst, ChangeLogDirName, name))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(srcInfo, dstInfo))
+	require.NoError(t, rkv.Close())
+
+	// the history up to the checkpoint is kept in the copy
+	cp, err := Open(dst, opts)
+	require.NoError(t, err)
+	require.NoError(t, cp.Set([]byte("k"), []byte("copy")))
+	sub, err := cp.Subscribe(1)
+	require.NoError(t, err)
+	for i := 1; i <= 20; i++ {
+		assert.Equal(t, []string{fmt.Sprintf("%d:k=%d", i, i)}, nextChanges(t, sub))
+	}
+	assert.Equal(t, []string{"21:k=copy"}, nextChanges(t, sub))
+	require.NoError(t, cp.Close())
+}
@@ -0,0 +1,525 @@
+// Command rabbitkv inspects and maintains the RabbitKV stores on disk.
+//
+// Usage:
+//
+//	rabbitkv <command> [arguments]
+//
+// The keys and values given as arguments are taken literally, or decoded from hex with -hex.
+// The dump and load commands use the same format, so the output of dump can be loaded into
+// another store.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/wide-key/RabbitKV"
+)
+
+// Replaced by the tests
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"create", "[-block-size n] [-seed n] <dir>  create an empty store", runCreate},
+		{"get", "[-hex] <dir> <key>  print the value of a key", runGet},
+		{"set", "[-hex] <dir> <key> <value>  set the value of a key", runSet},
+		{"delete", "[-hex] <dir> <key>  delete a key", runDelete},
+		{"stats", "<dir>  print the space usage", runStats},
+		{"dump", "[-format json|hex] <dir>  print all the pairs, one per line", runDump},
+		{"load", "[-format json|hex] [-batch n] <dir> [<file>]  import the pairs printed by dump", runLoad},
+		{"gc", "[-full] <dir>  run garbage collection until it is not needed, or over all the slots", runGC},
+		{"verify", "<dir>  check the files and report the inconsistencies", runVerify},
+		{"meta", "<dir>  print the meta file", runMeta},
+		{"repair", "<dir>  rebuild the index from the slots, discarding the corrupt ones", runRepair},
+		{"migrate", "<dir> [<dst-dir>]  upgrade the store to the current format, in place or into <dst-dir>", runMigrate},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: rabbitkv <command> [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", c.name, c.usage)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "rabbitkv %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	return fmt.Errorf("Unknown command, run rabbitkv -h for the commands")
+}
+
+// Parse the flags in 'fs' and check the number of the remaining arguments
+func parseArgs(fs *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() < minArgs || fs.NArg() > maxArgs {
+		return nil, fmt.Errorf("Expected %d to %d arguments, got %d", minArgs, maxArgs, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// The options of the commands which modify a store. The background garbage collector is
+// disabled, and ChangeLog and KeepVersions must match the ones used by the applications. A
+// store with a change log cannot be opened without -changelog
+func writeFlags(fs *flag.FlagSet) *rabbitkv.Options {
+	opts := &rabbitkv.Options{GCInterval: -1}
+	fs.BoolVar(&opts.ChangeLog, "changelog", false, "record the changes in the change log")
+	fs.Uint64Var(&opts.KeepVersions, "keep-versions", 0, "the number of the versions kept")
+	return opts
+}
+
+func readOnly() *rabbitkv.Options {
+	return &rabbitkv.Options{ReadOnly: true, GCInterval: -1}
+}
+
+// Run 'fn' with the store under 'dir', which is closed afterwards
+func withStore(dir string, opts *rabbitkv.Options, fn func(rkv *rabbitkv.RabbitKV) error) error {
+	rkv, err := rabbitkv.Open(dir, opts)
+	if err != nil {
+		return err
+	}
+	err = fn(rkv)
+	if e := rkv.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func decodeArg(arg string, isHex bool) ([]byte, error) {
+	if isHex {
+		return hex.DecodeString(arg)
+	}
+	return []byte(arg), nil
+}
+
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	opts := &rabbitkv.Options{GCInterval: -1}
+	fs.IntVar(&opts.BlockSize, "block-size", rabbitkv.DefaultBlockSize, "size of each HPFile block")
+	fs.Uint64Var(&opts.Seed, "seed", 0, "seed of the key hash, zero means a random one")
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	rkv, err := rabbitkv.CreateRabbitKV(args[0], opts)
+	if err != nil {
+		return err
+	}
+	return rkv.Close()
+}
+
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	isHex := fs.Bool("hex", false, "the key is given and the value is printed in hex")
+	args, err := parseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	key, err := decodeArg(args[1], *isHex)
+	if err != nil {
+		return err
+	}
+	return withStore(args[0], readOnly(), func(rkv *rabbitkv.RabbitKV) error {
+		value, err := rkv.Get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return errors.New("Key not found")
+		}
+		if *isHex {
+			_, err = fmt.Fprintln(stdout, hex.EncodeToString(value))
+		} else {
+			_, err = fmt.Fprintf(stdout, "%s\n", value)
+		}
+		return err
+	})
+}
+
+func runSet(args []string) error {
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	isHex := fs.Bool("hex", false, "the key and the value are given in hex")
+	opts := writeFlags(fs)
+	args, err := parseArgs(fs, args, 3, 3)
+	if err != nil {
+		return err
+	}
+	key, err := decodeArg(args[1], *isHex)
+	if err != nil {
+		return err
+	}
+	value, err := decodeArg(args[2], *isHex)
+	if err != nil {
+		return err
+	}
+	return withStore(args[0], opts, func(rkv *rabbitkv.RabbitKV) error {
+		return rkv.Set(key, value)
+	})
+}
+
+func runDelete(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	isHex := fs.Bool("hex", false, "the key is given in hex")
+	opts := writeFlags(fs)
+	args, err := parseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	key, err := decodeArg(args[1], *isHex)
+	if err != nil {
+		return err
+	}
+	return withStore(args[0], opts, func(rkv *rabbitkv.RabbitKV) error {
+		return rkv.Delete(key)
+	})
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return withStore(args[0], readOnly(), func(rkv *rabbitkv.RabbitKV) error {
+		s, err := rkv.Stats()
+		if err != nil {
+			return err
+		}
+		entries, minBits, maxBits := 0, s.ShardAddrBits[0], s.ShardAddrBits[0]
+		for i, bits := range s.ShardAddrBits {
+			entries += s.ShardEntries[i]
+			if bits < minBits {
+				minBits = bits
+			}
+			if bits > maxBits {
+				maxBits = bits
+			}
+		}
+		fmt.Fprintf(stdout, "active bytes:        %d\n", s.ActiveBytes)
+		fmt.Fprintf(stdout, "hpfile size:         %d\n", s.HPFileSize)
+		fmt.Fprintf(stdout, "head position:       %d\n", s.HeadPosition)
+		fmt.Fprintf(stdout, "next gc position:    %d\n", s.NextGcPosition)
+		fmt.Fprintf(stdout, "blocks:              %d\n", s.BlockCount)
+		fmt.Fprintf(stdout, "space amplification: %.2f\n", s.SpaceAmplification())
+		fmt.Fprintf(stdout, "index-log files:     %d\n", len(s.IndexLogFileSizes))
+		fmt.Fprintf(stdout, "index-log bytes:     %d\n", s.IndexLogBytes())
+		fmt.Fprintf(stdout, "index entries:       %d\n", entries)
+		_, err = fmt.Fprintf(stdout, "shard addrBits:      %d to %d\n", minBits, maxBits)
+		return err
+	})
+}
+
+// A line of the JSON format, whose keys and values are encoded in base64
+type jsonPair struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func encodePair(format string, key, value []byte) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.Marshal(jsonPair{Key: key, Value: value})
+	case "hex":
+		return []byte(hex.EncodeToString(key) + " " + hex.EncodeToString(value)), nil
+	}
+	return nil, fmt.Errorf("Unknown format %q", format)
+}
+
+func decodePair(format string, line []byte) (key, value []byte, err error) {
+	switch format {
+	case "json":
+		var p jsonPair
+		if err = json.Unmarshal(line, &p); err != nil {
+			return nil, nil, err
+		}
+		if p.Key == nil {
+			return nil, nil, errors.New("No key")
+		}
+		if p.Value == nil {
+			p.Value = []byte{}
+		}
+		return p.Key, p.Value, nil
+	case "hex":
+		// the value may be empty, so the line is split at the only space
+		fields := strings.Split(string(line), " ")
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("Expected 2 fields, got %d", len(fields))
+		}
+		if key, err = hex.DecodeString(fields[0]); err == nil {
+			value, err = hex.DecodeString(fields[1])
+		}
+		return
+	}
+	return nil, nil, fmt.Errorf("Unknown format %q", format)
+}
+
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	format := fs.String("format", "json", "json or hex")
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if _, err := encodePair(*format, nil, nil); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(stdout)
+	err = withStore(args[0], readOnly(), func(rkv *rabbitkv.RabbitKV) error {
+		var err error
+		fnErr := rkv.ForEach(func(key, value []byte) bool {
+			var line []byte
+			if line, err = encodePair(*format, key, value); err == nil {
+				line = append(line, '\n')
+				_, err = w.Write(line)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return fnErr
+	})
+	if e := w.Flush(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func runLoad(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	format := fs.String("format", "json", "json or hex")
+	batchSize := fs.Int("batch", 1000, "how many pairs are written in one batch")
+	opts := writeFlags(fs)
+	args, err := parseArgs(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	in := stdin
+	if len(args) == 2 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	r := bufio.NewReader(in)
+	return withStore(args[0], opts, func(rkv *rabbitkv.RabbitKV) error {
+		batch := rkv.NewBatch()
+		count := 0
+		for lineNum := 1; ; lineNum++ {
+			line, err := r.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				batch.Close()
+				return err
+			}
+			eof := err == io.EOF
+			if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+				key, value, err := decodePair(*format, line)
+				if err == nil {
+					err = batch.Set(key, value)
+				}
+				if err != nil {
+					batch.Close()
+					return fmt.Errorf("Line %d: %w", lineNum, err)
+				}
+				count++
+				if count%*batchSize == 0 {
+					if err = batch.Close(); err != nil {
+						return err
+					}
+					batch = rkv.NewBatch()
+				}
+			}
+			if eof {
+				break
+			}
+		}
+		if err := batch.Close(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(stdout, "loaded %d pairs\n", count)
+		return err
+	})
+}
+
+func runGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	full := fs.Bool("full", false, "collect all the slots written before, even if it is not needed")
+	opts := writeFlags(fs)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return withStore(args[0], opts, func(rkv *rabbitkv.RabbitKV) error {
+		before, err := rkv.Stats()
+		if err != nil {
+			return err
+		}
+		s := before
+		for {
+			last := s.NextGcPosition
+			if *full {
+				if int64(last) >= before.HPFileSize {
+					break
+				}
+				err = rkv.GabageCollect(rabbitkv.DefaultGCStepBytes, rabbitkv.DefaultGCStepSlots)
+			} else {
+				err = rkv.CollectGarbage()
+			}
+			if err != nil {
+				return err
+			}
+			if s, err = rkv.Stats(); err != nil {
+				return err
+			}
+			if s.NextGcPosition == last {
+				break // not needed, or blocked by the kept versions
+			}
+		}
+		_, err = fmt.Fprintf(stdout, "relocated %d slots, pruned %d blocks, hpfile bytes %d -> %d\n",
+			s.GCRelocations, s.GCPrunedBlocks, before.HPFileSize-before.HeadPosition,
+			s.HPFileSize-s.HeadPosition)
+		return err
+	})
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	report, err := rabbitkv.Verify(args[0], nil)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		fmt.Fprintln(stdout, p)
+	}
+	fmt.Fprintf(stdout, "%d slots, %d index entries, %d active bytes\n",
+		report.SlotCount, report.EntryCount, report.ActiveByteCount)
+	if !report.OK() {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+	return nil
+}
+
+func runMeta(args []string) error {
+	fs := flag.NewFlagSet("meta", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	mi, err := rabbitkv.ReadMetaInfo(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "format version:    %d\n", mi.FormatVersion())
+	fmt.Fprintf(stdout, "block size:        %d\n", mi.BlockSize())
+	fmt.Fprintf(stdout, "seed:              %#016x\n", mi.Seed())
+	fmt.Fprintf(stdout, "next gc position:  %d\n", mi.NextGcPosition())
+	fmt.Fprintf(stdout, "active byte count: %d\n", mi.ActiveByteCount())
+	fmt.Fprintf(stdout, "last batch seq:    %d\n", mi.LastBatchSeq())
+	fmt.Fprintf(stdout, "closed:            %t\n", mi.Closed())
+	fmt.Fprintf(stdout, "addrBits of the shards:\n")
+	allAddrBits := mi.AllAddrBits()
+	for i := 0; i < len(allAddrBits); i += 16 {
+		fmt.Fprintf(stdout, "  %02x:", i)
+		for _, bits := range allAddrBits[i : i+16] {
+			fmt.Fprintf(stdout, " %2d", bits)
+		}
+		if _, err = fmt.Fprintln(stdout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runRepair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	report, err := rabbitkv.Repair(args[0])
+	if err != nil {
+		return err
+	}
+	if report.CorruptMeta {
+		fmt.Fprintln(stdout, "the old meta file is corrupt")
+	}
+	if !report.IndexLogComplete {
+		fmt.Fprintln(stdout, "the old index logs are corrupt, the deleted keys may come back")
+	}
+	for _, r := range report.LostRegions {
+		fmt.Fprintf(stdout, "lost %d bytes in %s at %d\n", r.Length, r.File, r.Offset)
+	}
+	for _, key64 := range report.LostKeyHashes {
+		fmt.Fprintf(stdout, "lost the key of hash %#x\n", key64)
+	}
+	for _, key := range report.RevertedKeys {
+		fmt.Fprintf(stdout, "reverted the key %q to an older value\n", key)
+	}
+	_, err = fmt.Fprintf(stdout, "%d index entries are rebuilt\n", report.EntryCount)
+	return err
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	args, err := parseArgs(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+	dstDir := ""
+	if len(args) == 2 {
+		dstDir = args[1]
+	}
+	from, err := rabbitkv.Migrate(args[0], dstDir)
+	if err != nil {
+		return err
+	}
+	if from == rabbitkv.FormatVersion && dstDir == "" {
+		_, err = fmt.Fprintf(stdout, "already in format version %d\n", from)
+	} else {
+		_, err = fmt.Fprintf(stdout, "migrated from format version %d to %d\n", from, rabbitkv.FormatVersion)
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wide-key/RabbitKV"
+)
+
+// Run a command and return what it prints
+func runCmd(t *testing.T, input string, args ...string) string {
+	var out bytes.Buffer
+	stdin, stdout = strings.NewReader(input), &out
+	defer func() {
+		stdin, stdout = os.Stdin, os.Stdout
+	}()
+	require.NoError(t, run(args))
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	root, err := ioutil.TempDir("", "rabbitkv-cmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "src")
+
+	runCmd(t, "", "create", "-block-size", "4096", dir)
+	runCmd(t, "", "set", dir, "a", "1")
+	runCmd(t, "", "set", "-hex", dir, "00ff", "")
+	runCmd(t, "", "set", dir, "b", "2")
+	runCmd(t, "", "delete", dir, "b")
+	assert.Equal(t, "1\n", runCmd(t, "", "get", dir, "a"))
+	assert.Equal(t, "\n", runCmd(t, "", "get", "-hex", dir, "00ff"))
+	assert.Error(t, run([]string{"get", dir, "b"}))
+	assert.Error(t, run([]string{"get", dir}))
+	assert.Error(t, run([]string{"nonexistent"}))
+
+	// the dumped pairs are loaded into another store
+	for _, format := range []string{"json", "hex"} {
+		dump := runCmd(t, "", "dump", "-format", format, dir)
+		assert.Equal(t, 2, strings.Count(dump, "\n"))
+		dst := filepath.Join(root, format)
+		runCmd(t, "", "create", "-block-size", "4096", dst)
+		assert.Equal(t, "loaded 2 pairs\n", runCmd(t, dump, "load", "-format", format, "-batch", "1", dst))
+		assert.Equal(t, "1\n", runCmd(t, "", "get", dst, "a"))
+		assert.Equal(t, "\n", runCmd(t, "", "get", "-hex", dst, "00ff"))
+	}
+	assert.Error(t, run([]string{"load", dir, filepath.Join(root, "nonexistent")}))
+
+	for i := 0; i < 100; i++ {
+		runCmd(t, "", "set", dir, "a", strings.Repeat("x", 100))
+	}
+	stats := runCmd(t, "", "stats", dir)
+	assert.Contains(t, stats, "index entries:       2\n")
+	out := runCmd(t, "", "gc", "-full", dir)
+	assert.Contains(t, out, "relocated 2 slots")
+	assert.Contains(t, runCmd(t, "", "verify", dir), " 2 index entries, ")
+
+	meta := runCmd(t, "", "meta", dir)
+	assert.Contains(t, meta, "block size:        4096\n")
+	assert.Contains(t, meta, "closed:            true\n")
+	assert.Equal(t, 7+1+16, strings.Count(meta, "\n"))
+	assert.Equal(t, "2 index entries are rebuilt\n", runCmd(t, "", "repair", dir))
+	assert.Equal(t, "already in format version 1\n", runCmd(t, "", "migrate", dir))
+
+	// a store with a change log is only modified with -changelog
+	runCmd(t, "", "set", "-changelog", dir, "c", "3")
+	assert.Equal(t, rabbitkv.ErrChangeLogRequired, run([]string{"set", dir, "c", "4"}))
+	assert.Equal(t, "3\n", runCmd(t, "", "get", dir, "c"))
+}
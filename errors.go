@@ -0,0 +1,24 @@
+package rabbitkv
+
+import (
+	"errors"
+)
+
+var (
+	ErrCorruptSlot        = errors.New("Corrupt slot")
+	ErrCorruptIndexLog    = errors.New("Corrupt index log")
+	ErrCorruptMeta        = errors.New("Corrupt meta file")
+	ErrClosed             = errors.New("RabbitKV is closed")
+	ErrReadOnly           = errors.New("RabbitKV is read-only")
+	ErrNilValue           = errors.New("Cannot set a nil value")
+	ErrNoOrderedIndex     = errors.New("Ordered index is not enabled")
+	ErrReleased           = errors.New("Snapshot is released")
+	ErrNotVersioned       = errors.New("Versioned mode is not enabled")
+	ErrVersionUnavailable = errors.New("Version is unavailable")
+	ErrCorruptChangeLog   = errors.New("Corrupt change log")
+	ErrNoChangeLog        = errors.New("Change log is not enabled")
+	ErrChangeLogRequired  = errors.New("Change log exists, but is not enabled")
+	ErrChangeUnavailable  = errors.New("Change is unavailable")
+	ErrUnsupportedFormat  = errors.New("Unsupported format version")
+	ErrPositionWindowFull = errors.New("Retained HPFile blocks exceed the position window")
+)
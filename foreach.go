@@ -0,0 +1,43 @@
+package rabbitkv
+
+// Call 'fn' with every live key/value pair exactly once, in no particular order, until it returns
+// false. The shards of Hash3Bundle are visited one by one, and each shard is a point-in-time view
+// when it is visited, but the writes to the other shards can be seen during the visiting
+func (rkv *RabbitKV) ForEach(fn func(key, value []byte) bool) error {
+	for i := range rkv.hb.arr {
+		rkv.mtx.RLock()
+		if rkv.isClosed {
+			rkv.mtx.RUnlock()
+			return ErrClosed
+		}
+		var values []uint32
+		lock := rkv.hb.shardLock(uint64(i) << 56)
+		lock.RLock()
+		rkv.hb.scanShard(i, func(key uint32, value uint32) bool {
+			values = append(values, value)
+			return true
+		})
+		lock.RUnlock()
+		// the slots are read with only 'mtx' read-locked, which keeps them from being pruned
+		slots := make([]Slot, len(values))
+		var err error
+		for j, value := range values {
+			if slots[j], _, err = rkv.ReadSlot(rkv.slotPos(value)); err != nil {
+				break
+			}
+		}
+		rkv.mtx.RUnlock()
+		if err != nil {
+			return err
+		}
+		// 'fn' is called without locking, such that it can access this RabbitKV
+		for _, slot := range slots {
+			for _, pair := range slot.pairs {
+				if !fn(pair.key, pair.value) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package rabbitkv
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// The active slots live in [nextGcPosition, HPFile.Size()), garbage collection is needed
+// when the active bytes take a too small ratio of this range. 'mtx' must be read-locked
+func (rkv *RabbitKV) gcNeeded() bool {
+	total := rkv.hpfile.Size() - int64(rkv.mi.nextGcPosition)
+	active := atomic.LoadUint64(&rkv.mi.activeByteCount)
+	return total > 0 && float64(active) < rkv.opts.GCMinActiveRatio*float64(total)
+}
+
+// Run one step of garbage collection if activeByteCount is below Options.GCMinActiveRatio
+// of the bytes after nextGcPosition
+func (rkv *RabbitKV) CollectGarbage() error {
+	if rkv.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	rkv.mtx.RLock()
+	needed := rkv.gcNeeded()
+	rkv.mtx.RUnlock()
+	if needed {
+		return rkv.GabageCollect(rkv.opts.GCStepBytes, rkv.opts.GCStepSlots)
+	}
+	return nil
+}
+
+type slotAtPos struct {
+	slot Slot
+	pos  int64
+}
+
+// Run one step of garbage collection: the active ones among the first 'countLimit' slots in the
+// first 'lengthLimit' bytes after nextGcPosition are copied to the end of HPFile, and then
+// nextGcPosition is moved over these slots. The blocks before nextGcPosition are removed
+func (rkv *RabbitKV) GabageCollect(lengthLimit, countLimit int64) (err error) {
+	rkv.gcMtx.Lock()
+	defer rkv.gcMtx.Unlock()
+
+	// read the slots with mtx read-locked, without blocking the readers and the writers
+	rkv.mtx.RLock()
+	if rkv.isClosed {
+		rkv.mtx.RUnlock()
+		return ErrClosed
+	}
+	start := int64(rkv.mi.nextGcPosition)
+	end := start + lengthLimit
+	if size := rkv.hpfile.Size(); end > size {
+		end = size // the slots appended during this step are not touched
+	}
+	var slots []slotAtPos
+	gcEnd := start
+	err = rkv.ScanSlots(start, end, func(slot Slot, pos uint64, length int) bool {
+		if int64(len(slots)) >= countLimit {
+			return false
+		}
+		slots = append(slots, slotAtPos{slot, int64(pos)})
+		gcEnd = int64(pos) + int64(length)
+		return true
+	})
+	rkv.mtx.RUnlock()
+	if err != nil {
+		return
+	}
+
+	// copy the slots like the other writers, locking only the shards to publish the new positions
+	rkv.wmtx.Lock()
+	defer rkv.wmtx.Unlock()
+	if err = rkv.checkWritable(); err != nil {
+		return
+	}
+	for _, s := range slots {
+		if s.slot.Empty() {
+			continue
+		}
+		key64 := rkv.slotKey64(&s.slot)
+		// the slot may be overwritten after it was read, so check it with wmtx locked
+		if rkv.findSlotAt(key64, s.pos) == nil {
+			continue
+		}
+		var newPos int64
+		var length int
+		newPos, length, err = rkv.appendSlot(&s.slot)
+		if errors.Is(err, ErrPositionWindowFull) {
+			return // nothing is written for this slot, and the relocated ones are published
+		} else if err != nil {
+			return rkv.fail(err)
+		}
+		if err = rkv.writeLogOrFail(key64, value32Of(newPos)); err != nil {
+			return
+		}
+		rkv.publishInShard(&pendingUpdate{key64: key64, value32: value32Of(newPos)})
+		rkv.gcRelocations++
+		rkv.gcRelocatedBytes += uint64(length)
+		if err = rkv.maybeAddNewLogFile(); err != nil {
+			return
+		}
+	}
+	rkv.mtx.Lock()
+	rkv.mi.nextGcPosition = uint64(gcEnd)
+	rkv.mtx.Unlock()
+	blockSize := int64(rkv.mi.blockSize)
+	if gcEnd/blockSize > start/blockSize {
+		err = rkv.pruneHead()
+	}
+	return
+}
+
+// Remove the blocks before nextGcPosition, except the ones pinned by snapshots. Before that, the copied slots and their index-log
+// entries are flushed and nextGcPosition is persisted, such that the removed blocks are not
+// needed by recovery. 'wmtx' must be locked, and 'mtx' is locked for pruning, such that the
+// readers of the removed blocks are waited for
+func (rkv *RabbitKV) pruneHead() error {
+	err := rkv.sync()
+	if err == nil {
+		err = rkv.SaveMetaFile()
+	}
+	if err != nil {
+		return rkv.fail(err)
+	}
+	rkv.mtx.Lock()
+	defer rkv.mtx.Unlock()
+	blockCount := rkv.hpfile.BlockCount()
+	if err = rkv.hpfile.PruneHead(rkv.pruneLimit()); err != nil {
+		return rkv.fail(err)
+	}
+	rkv.gcPrunes++
+	rkv.gcPrunedBlocks += uint64(blockCount - rkv.hpfile.BlockCount())
+	return nil
+}
+
+// Check every GCInterval and run the steps of garbage collection until it is not needed.
+// It exits when stopped or any step fails, and the error is recorded in gcErr
+func (rkv *RabbitKV) backgroundGC() {
+	ticker := time.NewTicker(rkv.opts.GCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rkv.bgStop:
+			return
+		case <-ticker.C:
+		}
+		for {
+			rkv.mtx.RLock()
+			needed := !rkv.isClosed && rkv.gcNeeded()
+			rkv.mtx.RUnlock()
+			if !needed {
+				break
+			}
+			if err := rkv.GabageCollect(rkv.opts.GCStepBytes, rkv.opts.GCStepSlots); err != nil {
+				rkv.mtx.Lock()
+				rkv.gcErr = err
+				rkv.mtx.Unlock()
+				return
+			}
+			if rkv.opts.GCStepPause > 0 {
+				select {
+				case <-rkv.bgStop:
+					return
+				case <-time.After(rkv.opts.GCStepPause):
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func countBlocks(t *testing.T, dir string) int {
+	files, err := ioutil.ReadDir(filepath.Join(dir, HPFileDirName))
+	require.NoError(t, err)
+	return len(files)
+}
+
+// Overwrite the same keys again and again to produce garbage
+func overwrite(t *testing.T, rkv *RabbitKV, rounds int) {
+	for r := 0; r < rounds; r++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			require.NoError(t, rkv.Set(key, []byte(fmt.Sprintf("value%d-%d", i, r))))
+		}
+	}
+}
+
+func checkOverwritten(t *testing.T, rkv *RabbitKV, rounds int) {
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, fmt.Sprintf("value%d-%d", i, rounds-1), getString(t, rkv, fmt.Sprintf("key%d", i)))
+	}
+}
+
+func TestGCRatioDisabled(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1, GCMinActiveRatio: -1}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	overwrite(t, rkv, 20)
+	blocks := countBlocks(t, dir)
+	assert.False(t, rkv.gcNeeded())
+	require.NoError(t, rkv.CollectGarbage())
+	assert.Equal(t, blocks, countBlocks(t, dir))
+	require.NoError(t, rkv.GabageCollect(1<<20, 1<<20))
+	assert.True(t, countBlocks(t, dir) < blocks)
+	checkOverwritten(t, rkv, 20)
+	require.NoError(t, rkv.Close())
+}
+
+func TestGarbageCollection(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1, GCStepBytes: 1000, GCStepSlots: 10}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	overwrite(t, rkv, 20)
+	blocks := countBlocks(t, dir)
+	assert.True(t, rkv.gcNeeded())
+	steps := 0
+	for rkv.gcNeeded() {
+		require.NoError(t, rkv.CollectGarbage())
+		steps++
+	}
+	assert.True(t, steps > 1) // the steps are bounded
+	assert.True(t, countBlocks(t, dir) < blocks/2)
+	assert.False(t, rkv.gcNeeded())
+	checkOverwritten(t, rkv, 20)
+	nextGc := rkv.mi.nextGcPosition
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	assert.Equal(t, nextGc, rkv.mi.nextGcPosition)
+	checkOverwritten(t, rkv, 20)
+
+	// the pruned blocks are not needed by recovery
+	overwrite(t, rkv, 10)
+	for rkv.gcNeeded() {
+		require.NoError(t, rkv.CollectGarbage())
+	}
+	crash(rkv)
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	checkOverwritten(t, rkv, 10)
+	require.NoError(t, rkv.Close())
+}
+
+func TestBackgroundGC(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: time.Millisecond, GCStepBytes: 1000, GCStepPause: -1}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	overwrite(t, rkv, 30)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rkv.mtx.RLock()
+		needed := rkv.gcNeeded()
+		rkv.mtx.RUnlock()
+		if !needed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, countBlocks(t, dir) < 10)
+	checkOverwritten(t, rkv, 30)
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	checkOverwritten(t, rkv, 30)
+	require.NoError(t, rkv.Close())
+}
+
+func TestStats(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	overwrite(t, rkv, 20)
+	s, err := rkv.Stats()
+	require.NoError(t, err)
+	total := 0
+	for i := range s.ShardEntries {
+		total += s.ShardEntries[i]
+		assert.Equal(t, byte(MinAddrBits), s.ShardAddrBits[i])
+	}
+	assert.Equal(t, 100, total)
+	assert.Equal(t, int64(0), s.HeadPosition)
+	assert.Equal(t, uint64(0), s.NextGcPosition)
+	assert.Equal(t, countBlocks(t, dir), s.BlockCount)
+	assert.True(t, s.IndexLogBytes() >= 2000*EntryLengthInLog)
+	assert.True(t, s.SpaceAmplification() > 10)
+	assert.Equal(t, uint64(0), s.GCRelocations)
+
+	for rkv.gcNeeded() {
+		require.NoError(t, rkv.CollectGarbage())
+	}
+	s2, err := rkv.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, s.ActiveBytes, s2.ActiveBytes)
+	assert.True(t, s2.HeadPosition > 0)
+	assert.True(t, s2.NextGcPosition >= uint64(s2.HeadPosition))
+	assert.True(t, s2.GCRelocations >= 100)
+	assert.True(t, s2.GCRelocatedBytes >= s.ActiveBytes)
+	assert.True(t, s2.GCPrunes > 0)
+	assert.Equal(t, uint64(s2.HeadPosition/4096), s2.GCPrunedBlocks)
+	assert.True(t, s2.SpaceAmplification() < 3)
+	require.NoError(t, rkv.Close())
+	_, err = rkv.Stats()
+	assert.Equal(t, ErrClosed, err)
+}
@@ -3,7 +3,7 @@ module github.com/wide-key/RabbitKV
 go 1.13
 
 require (
-	github.com/coinexchain/randsrc v0.1.0 // indirect
+	github.com/coinexchain/randsrc v0.1.0
 	github.com/minio/sha256-simd v0.1.1
 	github.com/mmcloughlin/meow v0.0.0-20200201185800-3501c7c05d21
 	github.com/stretchr/testify v1.5.1
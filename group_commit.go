@@ -0,0 +1,82 @@
+package rabbitkv
+
+import (
+	"sync"
+	"time"
+)
+
+// The writers wait for flushing without locking 'mtx'. One of them flushes the files for all the
+// writes made so far, while the others wait for it, and the writes made during flushing wait for
+// the next flush. Thus the concurrent writers share one flush
+type groupSyncer struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	synced  uint64 // the writes whose tickets are not larger than it have been flushed
+	syncing bool
+	err     error
+	flushes uint64 // how many times the files are flushed
+}
+
+// Wait until the write of 'ticket' is flushed
+func (rkv *RabbitKV) waitSynced(ticket uint64) error {
+	gs := &rkv.gs
+	gs.mtx.Lock()
+	defer gs.mtx.Unlock()
+	for gs.synced < ticket {
+		if gs.err != nil {
+			return gs.err
+		}
+		if gs.syncing {
+			gs.cond.Wait()
+			continue
+		}
+		gs.syncing = true
+		gs.mtx.Unlock()
+		synced, err := rkv.syncWritten()
+		gs.mtx.Lock()
+		gs.syncing = false
+		gs.flushes++
+		if err != nil {
+			gs.err = err
+		} else if gs.synced < synced {
+			gs.synced = synced
+		}
+		gs.cond.Broadcast()
+	}
+	return nil
+}
+
+// Flush all the writes made so far and return the last ticket. The writers are blocked
+// during flushing but the readers are not
+func (rkv *RabbitKV) syncWritten() (uint64, error) {
+	rkv.wmtx.Lock()
+	defer rkv.wmtx.Unlock()
+	ticket := rkv.writeTicket
+	if rkv.isClosed {
+		return ticket, nil // flushed by Close
+	}
+	err := rkv.sync()
+	if err != nil {
+		rkv.fail(err)
+	}
+	return ticket, err
+}
+
+// Flush the writes every interval of Options.Sync
+func (rkv *RabbitKV) backgroundSync() {
+	ticker := time.NewTicker(rkv.opts.Sync.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rkv.bgStop:
+			return
+		case <-ticker.C:
+		}
+		rkv.wmtx.Lock()
+		ticket := rkv.writeTicket
+		rkv.wmtx.Unlock()
+		if rkv.waitSynced(ticket) != nil {
+			return // the error is sticky and returned by the following writes
+		}
+	}
+}
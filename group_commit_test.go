@@ -0,0 +1,103 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096, GCInterval: -1})
+	require.NoError(t, err)
+	// pretend that a flush is running, such that the writers wait for the next flush
+	rkv.gs.mtx.Lock()
+	rkv.gs.syncing = true
+	rkv.gs.mtx.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			batch := rkv.NewBatch()
+			assert.NoError(t, batch.Set([]byte(fmt.Sprintf("key%d", i)), []byte("v")))
+			assert.NoError(t, batch.Close())
+		}(i)
+	}
+	// single writes do not wait in SyncOnBatch mode
+	require.NoError(t, rkv.Set([]byte("single"), []byte("v")))
+	for {
+		rkv.wmtx.Lock()
+		written := rkv.writeTicket
+		rkv.wmtx.Unlock()
+		if written == 11 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rkv.gs.mtx.Lock()
+	rkv.gs.syncing = false
+	rkv.gs.cond.Broadcast()
+	rkv.gs.mtx.Unlock()
+	wg.Wait()
+	assert.Equal(t, uint64(1), rkv.gs.flushes) // one flush for all of them
+	assert.Equal(t, uint64(11), rkv.gs.synced)
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, &Options{Sync: SyncEveryWrite})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.NoError(t, rkv.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprint(j))))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(200), rkv.gs.synced)
+	assert.True(t, rkv.gs.flushes <= 200)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "19", getString(t, rkv, fmt.Sprintf("key%d", i)))
+	}
+	require.NoError(t, rkv.Close())
+}
+
+func TestSyncPolicy(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := CreateRabbitKV(dir, &Options{Sync: SyncInterval(0)})
+	assert.Error(t, err)
+	assert.Equal(t, "SyncInterval(5ms)", SyncInterval(5*time.Millisecond).String())
+	assert.Equal(t, "SyncOnBatch", Options{}.Sync.String())
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096, Sync: SyncInterval(time.Millisecond)})
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("key"), []byte("v")))
+	batch := rkv.NewBatch()
+	require.NoError(t, batch.Set([]byte("key2"), []byte("v")))
+	require.NoError(t, batch.Close())
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rkv.gs.mtx.Lock()
+		synced := rkv.gs.synced
+		rkv.gs.mtx.Unlock()
+		if synced == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rkv.gs.mtx.Lock()
+	assert.Equal(t, uint64(2), rkv.gs.synced)
+	rkv.gs.mtx.Unlock()
+	require.NoError(t, rkv.Close())
+}
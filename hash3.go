@@ -2,13 +2,16 @@ package rabbitkv
 
 import (
 	"math/bits"
+	"sync"
 )
 
 const (
-	MinAddrBits = 4
-	Found = 1
+	MinAddrBits          = 4
+	Found                = 1
 	NotFoundAndCanInsert = 2
-	NotFoundAndFull = 3
+	NotFoundAndFull      = 3
+	// How many buckets of the old table are migrated by each change to a shard being enlarged
+	MigrationStep = 8
 )
 
 type KV32 struct {
@@ -29,6 +32,8 @@ type L2Bucket = [16]KV32
 type L3Bucket = [32]KV32
 
 type Hash3 struct {
+	gen      uint64 // the generation of Hash3Bundle when it was created
+	migrated int    // only used by an old table, the buckets before it have been migrated
 	addrBits uint32
 	addrMask uint32
 	buc1     []L1Bucket
@@ -43,18 +48,31 @@ func NewHash3(addrBits uint32) *Hash3 {
 	length := 1 << addrBits
 	return &Hash3{
 		addrBits: uint32(addrBits),
-		addrMask: uint32(length-1),
-		buc1: make([]L1Bucket, length),
-		buc2: make([]L2Bucket, length/4),
-		buc3: make([]L3Bucket, length/16),
+		addrMask: uint32(length - 1),
+		buc1:     make([]L1Bucket, length),
+		buc2:     make([]L2Bucket, length/4),
+		buc3:     make([]L3Bucket, length/16),
+	}
+}
+
+// Return a deep copy
+func (h *Hash3) clone() *Hash3 {
+	return &Hash3{
+		gen:      h.gen,
+		migrated: h.migrated,
+		addrBits: h.addrBits,
+		addrMask: h.addrMask,
+		buc1:     append([]L1Bucket{}, h.buc1...),
+		buc2:     append([]L2Bucket{}, h.buc2...),
+		buc3:     append([]L3Bucket{}, h.buc3...),
 	}
 }
 
 func (h *Hash3) getSlices(key uint32) [3][]KV32 {
 	idx1 := key & h.addrMask
-	idx2 := bits.Reverse32(key) & h.addrMask // another hash method
+	idx2 := bits.Reverse32(key) & h.addrMask         // another hash method
 	idx3 := (bits.Reverse32(key) + key) & h.addrMask //yet another hash method
-	return [3][]KV32 {
+	return [3][]KV32{
 		h.buc1[idx1][:],
 		h.buc2[idx2/4][:],
 		h.buc3[idx3/16][:],
@@ -94,40 +112,128 @@ func (h *Hash3) FindX(key uint32) (*KV32, int) {
 	return &(slices[0][0]), NotFoundAndFull
 }
 
-func (h *Hash3) Scan(fn func(key uint32, value uint32) ) {
-	for _, buc := range h.buc1 {
-		for _, e := range buc {
-			if e.IsValid() {
-				fn(e.Key, e.Value)
-			}
+// Visit all the valid entries in the L1, L2 and L3 buckets, in this order
+func (h *Hash3) Scan(fn func(key uint32, value uint32)) {
+	h.ScanAll(func(key uint32, value uint32) bool {
+		fn(key, value)
+		return true
+	})
+}
+
+// Visit all the valid entries in the L1, L2 and L3 buckets, in this order. The visiting
+// stops when 'fn' returns false
+func (h *Hash3) ScanAll(fn func(key uint32, value uint32) bool) {
+	for i := range h.buc1 {
+		if !scanEntries(h.buc1[i][:], fn) {
+			return
+		}
+	}
+	for i := range h.buc2 {
+		if !scanEntries(h.buc2[i][:], fn) {
+			return
 		}
 	}
+	for i := range h.buc3 {
+		if !scanEntries(h.buc3[i][:], fn) {
+			return
+		}
+	}
+}
+
+func scanEntries(entries []KV32, fn func(key uint32, value uint32) bool) bool {
+	for _, e := range entries {
+		if e.IsValid() && !fn(e.Key, e.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// The exact count of valid entries
+func (h *Hash3) Len() (n int) {
+	h.Scan(func(key uint32, value uint32) {
+		n++
+	})
+	return
+}
+
+// The count of the L1, L2 and L3 buckets
+func (h *Hash3) bucketCount() int {
+	return len(h.buc1) + len(h.buc2) + len(h.buc3)
+}
+
+// Return the entries of the i-th bucket, counting the L1, L2 and L3 buckets in order
+func (h *Hash3) bucket(i int) []KV32 {
+	if i < len(h.buc1) {
+		return h.buc1[i][:]
+	}
+	i -= len(h.buc1)
+	if i < len(h.buc2) {
+		return h.buc2[i][:]
+	}
+	return h.buc3[i-len(h.buc2)][:]
 }
 
-func (h *Hash3) InitFrom(other *Hash3) {
-	other.Scan(func(key uint32, value uint32) {
+// Insert all the valid entries of 'other' into h, which must not contain any of their keys.
+// Return false if some entry cannot be inserted because its buckets are full
+func (h *Hash3) InitFrom(other *Hash3) (ok bool) {
+	ok = true
+	other.ScanAll(func(key uint32, value uint32) bool {
 		kv32, status := h.FindX(key)
 		if status == Found {
 			panic("Duplicated key")
 		}
 		if status == NotFoundAndFull {
-			panic("No more space")
+			ok = false
+			return false
 		}
+		kv32.Key = key
 		kv32.Value = value
+		return true
 	})
+	return
 }
 
+// A copy of Hash3Bundle shares the Hash3 shards with the original one. The generation is
+// increased after copying, and a shard of an older generation is copied before being changed,
+// such that the copy is never changed. Each shard has a lock, such that a shard can be changed
+// or enlarged without blocking the lookups in the other shards, but the locking is left to the users.
+//
+// A shard is enlarged incrementally: the full table is kept in 'old' and a larger one takes its
+// place in 'arr', then every change to the shard migrates MigrationStep buckets of the old table
+// into the larger one, until the old table is dropped. The lookups search both of them
 type Hash3Bundle struct {
-	arr  [256]*Hash3
+	arr   [256]*Hash3
+	old   [256]*Hash3
+	gen   uint64
+	locks *[256]sync.RWMutex
 }
 
 func NewHash3Bundle(allAddrBits [256]byte) (hb Hash3Bundle) {
 	for i := range hb.arr {
 		hb.arr[i] = NewHash3(uint32(allAddrBits[i]))
 	}
+	hb.locks = new([256]sync.RWMutex)
 	return
 }
 
+// Return the lock of the shard of 'key'
+func (hb *Hash3Bundle) shardLock(key uint64) *sync.RWMutex {
+	return &hb.locks[key>>56]
+}
+
+// Return the value of the valid entry of 'key', or zero if not found. The shard is read-locked,
+// so it can be called when the shard is being changed with its lock locked
+func (hb *Hash3Bundle) lookup(key uint64) uint32 {
+	lock := hb.shardLock(key)
+	lock.RLock()
+	defer lock.RUnlock()
+	if kv32 := hb.Find(key); kv32 != nil {
+		return kv32.Value
+	}
+	return 0
+}
+
 func (hb *Hash3Bundle) GetAllAddrBits() (res [256]byte) {
 	for i := range res {
 		res[i] = byte(hb.arr[i].addrBits)
@@ -136,27 +242,169 @@ func (hb *Hash3Bundle) GetAllAddrBits() (res [256]byte) {
 }
 
 func (hb *Hash3Bundle) Find(key uint64) *KV32 {
-	pos := int(key>>56)
-	return hb.arr[pos].Find(uint32(key))
+	pos := int(key >> 56)
+	if kv32 := hb.arr[pos].Find(uint32(key)); kv32 != nil {
+		return kv32
+	}
+	if old := hb.old[pos]; old != nil {
+		return old.Find(uint32(key))
+	}
+	return nil
 }
 
+// Same as Hash3.FindX, the returned entry can be changed. If the shard is being enlarged, some
+// buckets are migrated, and a found entry is moved out of the old table before being returned
 func (hb *Hash3Bundle) FindX(key uint64) (*KV32, int) {
-	pos := int(key>>56)
-	return hb.arr[pos].FindX(uint32(key))
+	pos := int(key >> 56)
+	hb.own(pos)
+	hb.migrate(pos, MigrationStep)
+	kv32, status := hb.arr[pos].FindX(uint32(key))
+	if old := hb.old[pos]; old != nil && status != Found {
+		if e := old.Find(uint32(key)); e != nil {
+			if status == NotFoundAndFull {
+				return kv32, status // it will be moved after EnlargeForKey
+			}
+			*kv32 = *e
+			e.Value = 0 // invalidate it
+			return kv32, Found
+		}
+	}
+	return kv32, status
+}
+
+// Make sure the shard at 'pos' is not shared with any copy before changing it
+func (hb *Hash3Bundle) own(pos int) {
+	if h := hb.arr[pos]; h.gen != hb.gen {
+		hb.arr[pos] = h.clone()
+		hb.arr[pos].gen = hb.gen
+	}
+	if h := hb.old[pos]; h != nil && h.gen != hb.gen {
+		hb.old[pos] = h.clone()
+		hb.old[pos].gen = hb.gen
+	}
+}
+
+// Move the valid entries in the next 'n' buckets of the old table of shard 'pos' into the larger
+// one, and drop the old table when all of its buckets are migrated. The shard must be owned
+func (hb *Hash3Bundle) migrate(pos int, n int) {
+	old := hb.old[pos]
+	if old == nil {
+		return
+	}
+	for ; n > 0 && old.migrated < old.bucketCount(); n-- {
+		entries := old.bucket(old.migrated)
+		for i := range entries {
+			e := &entries[i]
+			if !e.IsValid() {
+				continue
+			}
+			kv32, status := hb.arr[pos].FindX(e.Key)
+			if status == NotFoundAndFull {
+				// the larger table is not large enough, which is rare, so rebuild it at once
+				hb.rebuild(pos, hb.arr[pos].addrBits+1)
+				return
+			}
+			if status != Found { // a moved entry is never found in the old table
+				*kv32 = *e
+			}
+			e.Value = 0
+		}
+		old.migrated++
+	}
+	if old.migrated == old.bucketCount() {
+		hb.old[pos] = nil
+	}
+}
+
+// Move all the entries of shard 'pos' into a new table at once, whose addrBits is at least 'addrBits'
+func (hb *Hash3Bundle) rebuild(pos int, addrBits uint32) {
+	// doubling may be not enough when many keys share the same buckets
+	for ; ; addrBits++ {
+		h := NewHash3(addrBits)
+		h.gen = hb.gen
+		if h.InitFrom(hb.arr[pos]) && (hb.old[pos] == nil || h.InitFrom(hb.old[pos])) {
+			hb.arr[pos], hb.old[pos] = h, nil
+			return
+		}
+	}
+}
+
+// Return a copy which will never be changed
+func (hb *Hash3Bundle) snapshot() Hash3Bundle {
+	res := *hb
+	res.locks = new([256]sync.RWMutex)
+	hb.gen++
+	return res
+}
+
+// Enlarge the shard of 'key' if 'key' cannot be inserted into it
+func (hb *Hash3Bundle) ensureRoom(key uint64) {
+	if _, status := hb.arr[key>>56].FindX(uint32(key)); status == NotFoundAndFull {
+		hb.EnlargeForKey(key)
+	}
 }
 
+// Start enlarging the shard of 'key', after which 'key' can be inserted. The entries are migrated
+// later by FindX, unless the shard is being enlarged and has to be rebuilt at once
 func (hb *Hash3Bundle) EnlargeForKey(key uint64) {
-	pos := int(key>>56)
-	old := hb.arr[pos]
-	hb.arr[pos] = NewHash3(old.addrBits+1)
-	hb.arr[pos].InitFrom(old)
+	pos := int(key >> 56)
+	hb.own(pos)
+	if hb.old[pos] != nil {
+		hb.rebuild(pos, hb.arr[pos].addrBits+1)
+		return
+	}
+	h := NewHash3(hb.arr[pos].addrBits + 1)
+	h.gen = hb.gen
+	hb.arr[pos], hb.old[pos] = h, hb.arr[pos]
+}
+
+// Visit the valid entries of shard 'pos' in the order of Hash3.ScanAll, the larger table first
+// if it is being enlarged. The visiting stops when 'fn' returns false
+func (hb *Hash3Bundle) scanShard(pos int, fn func(key uint32, value uint32) bool) {
+	stopped := false
+	hb.arr[pos].ScanAll(func(key uint32, value uint32) bool {
+		stopped = !fn(key, value)
+		return !stopped
+	})
+	if old := hb.old[pos]; old != nil && !stopped {
+		old.ScanAll(fn)
+	}
+}
+
+// Visit all the valid entries, shard by shard from the 0th to the 255th. Inside a shard, the
+// entries are visited in the order of scanShard. The shard index is restored as the highest
+// byte of 'key', only the lowest 32 bits of the other ones are available
+func (hb *Hash3Bundle) Scan(fn func(key uint64, value uint32)) {
+	for i := range hb.arr {
+		hb.scanShard(i, func(key uint32, value uint32) bool {
+			fn((uint64(i)<<56)|uint64(key), value)
+			return true
+		})
+	}
+}
+
+// The exact count of valid entries in shard 'pos'
+func (hb *Hash3Bundle) shardLen(pos int) (n int) {
+	hb.scanShard(pos, func(key uint32, value uint32) bool {
+		n++
+		return true
+	})
+	return
+}
+
+// The exact count of valid entries in all the shards
+func (hb *Hash3Bundle) Len() (n int) {
+	for i := range hb.arr {
+		n += hb.shardLen(i)
+	}
+	return
 }
 
 func (hb *Hash3Bundle) EstimatedCount() int64 {
 	count := float64(0)
 	for i := range hb.arr {
-		n := (1<<hb.arr[i].addrBits)*(8+6)
-		count += float64(n)*0.75
+		n := (1 << hb.arr[i].addrBits) * (8 + 6)
+		count += float64(n) * 0.75
 	}
 	return int64(count)
 }
@@ -166,7 +414,8 @@ func (hb *Hash3Bundle) Set(key uint64, value uint32) {
 	if status == NotFoundAndFull {
 		hb.EnlargeForKey(key)
 		hb.Set(key, value)
-	} else /*NotFoundAndCanInsert or Found*/{
+	} else /*NotFoundAndCanInsert or Found*/ {
+		kv32.Key = uint32(key)
 		kv32.Value = value
 	}
 }
@@ -0,0 +1,165 @@
+package rabbitkv
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Insert the keys into a bundle of the smallest tables, and check that no key is lost
+// as the tables grow
+func checkBundleGrowth(t *testing.T, keys []uint64) bool {
+	var allAddrBits [256]byte
+	for i := range allAddrBits {
+		allAddrBits[i] = MinAddrBits
+	}
+	hb := NewHash3Bundle(allAddrBits)
+	ref := make(map[uint64]uint32)
+	for i, key := range keys {
+		key &= 0xFF000000FFFFFFFF // only these bits are used
+		value := uint32(i + 1)
+		hb.Set(key, value)
+		ref[key] = value
+	}
+	if hb.Len() != len(ref) {
+		t.Logf("Len %d != %d", hb.Len(), len(ref))
+		return false
+	}
+	for key, value := range ref {
+		kv32 := hb.Find(key)
+		if kv32 == nil || kv32.Value != value {
+			t.Logf("Key %x is lost", key)
+			return false
+		}
+	}
+	visited := make(map[uint64]bool)
+	lastShard := uint64(0)
+	ok := true
+	hb.Scan(func(key uint64, value uint32) {
+		if visited[key] || ref[key] != value || key>>56 < lastShard {
+			ok = false
+		}
+		visited[key] = true
+		lastShard = key >> 56
+	})
+	return ok && len(visited) == len(ref)
+}
+
+func TestHash3BundleGrowth(t *testing.T) {
+	// random keys
+	err := quick.Check(func(keys []uint64) bool {
+		return checkBundleGrowth(t, keys)
+	}, &quick.Config{MaxCount: 50, Rand: rand.New(rand.NewSource(1))})
+	require.NoError(t, err)
+
+	// many keys in a few shards, and keys sharing their lowest bits
+	err = quick.Check(func(keys []uint64) bool {
+		for i := range keys {
+			keys[i] &= 0x0300000000FFF0FF
+		}
+		return checkBundleGrowth(t, keys)
+	}, &quick.Config{MaxCount: 50, Rand: rand.New(rand.NewSource(2))})
+	require.NoError(t, err)
+
+	r := rand.New(rand.NewSource(3))
+	keys := make([]uint64, 20000)
+	for i := range keys {
+		keys[i] = uint64(r.Uint32()) | uint64(r.Intn(4))<<56
+	}
+	assert.True(t, checkBundleGrowth(t, keys))
+}
+
+func TestHash3ScanOrder(t *testing.T) {
+	h := NewHash3(MinAddrBits)
+	// all of them share the same L1 bucket, such that the L2 and L3 buckets are used
+	for i := uint32(1); i <= 20; i++ {
+		kv32, status := h.FindX(i << 4)
+		require.Equal(t, NotFoundAndCanInsert, status)
+		kv32.Key, kv32.Value = i<<4, i
+	}
+	var values []uint32
+	h.Scan(func(key uint32, value uint32) {
+		values = append(values, value)
+	})
+	// the entries in L1 come first
+	assert.Equal(t, []uint32{1, 2, 3, 4, 5, 6, 7, 8}, values[:8])
+	assert.Equal(t, 20, len(values))
+	assert.Equal(t, 20, h.Len())
+
+	count := 0
+	h.ScanAll(func(key uint32, value uint32) bool {
+		count++
+		return count < 10
+	})
+	assert.Equal(t, 10, count)
+
+	bigger := NewHash3(MinAddrBits + 1)
+	require.True(t, bigger.InitFrom(h))
+	assert.Equal(t, 20, bigger.Len())
+	for i := uint32(1); i <= 20; i++ {
+		assert.Equal(t, i, bigger.Find(i<<4).Value)
+	}
+}
+
+func TestHash3BundleIncrementalEnlarge(t *testing.T) {
+	var allAddrBits [256]byte
+	for i := range allAddrBits {
+		allAddrBits[i] = MinAddrBits
+	}
+	hb := NewHash3Bundle(allAddrBits)
+	ref := make(map[uint64]uint32)
+	r := rand.New(rand.NewSource(4))
+	set := func(key uint64, value uint32) {
+		hb.Set(key, value)
+		ref[key] = value
+	}
+	for hb.old[0] == nil || hb.arr[0].addrBits < 10 {
+		set(uint64(r.Uint32()), uint32(len(ref)+1))
+	}
+	// only a few buckets are migrated when the enlargement starts
+	count := len(ref)
+	assert.True(t, hb.arr[0].Len() <= 1+MigrationStep*32)
+	assert.Equal(t, count, hb.Len())
+	snap := hb.snapshot()
+
+	// update and delete some keys during the migration
+	deleted := 0
+	for key := range ref {
+		if deleted%2 == 0 {
+			hb.Set(key, 0)
+			ref[key] = 0
+		} else {
+			set(key, ref[key]+1000)
+		}
+		deleted++
+		if deleted == 10 {
+			break
+		}
+	}
+	assert.NotNil(t, hb.old[0])
+	for key, value := range ref {
+		kv32 := hb.Find(key)
+		if value == 0 {
+			assert.Nil(t, kv32)
+		} else {
+			require.NotNil(t, kv32)
+			assert.Equal(t, value, kv32.Value)
+		}
+	}
+	// the snapshot taken during the migration is not changed
+	assert.Equal(t, count, snap.Len())
+	for i := 0; hb.old[0] != nil; i++ {
+		set(uint64(r.Uint32()), uint32(i+1))
+	}
+	assert.Equal(t, count, snap.Len())
+	n := 0
+	for _, value := range ref {
+		if value != 0 {
+			n++
+		}
+	}
+	assert.Equal(t, n, hb.Len())
+}
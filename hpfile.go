@@ -6,18 +6,23 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-// Head prune-able file
+// Head prune-able file. Append must not be called concurrently, but the other methods can be
+// called during appending. The bytes appended are visible to ReadAt and Size after Append returns
 type HPFile struct {
-	fileMap   map[int]*os.File
-	blockSize int
-	dirName   string
-	largestID int
+	mtx        *sync.RWMutex // guards the fields below, but not the file I/O
+	fileMap    map[int]*os.File
+	blockSize  int
+	dirName    string
+	largestID  int
+	latestSize int64 // size of the latest file
 }
 
-func NewHPFile(blockSize int, dirName string) (HPFile, error) {
+func NewHPFile(blockSize int, dirName string, readOnly bool) (HPFile, error) {
 	res := HPFile{
+		mtx:       &sync.RWMutex{},
 		fileMap:   make(map[int]*os.File),
 		blockSize: blockSize,
 		dirName:   dirName,
@@ -33,7 +38,7 @@ func NewHPFile(blockSize int, dirName string) (HPFile, error) {
 		}
 		twoParts := strings.Split(fileInfo.Name(), "-")
 		if len(twoParts) != 2 {
-			return res, fmt.Errorf("%s does not match the pattern 'FileId-BlockSize'", fileInfo.Name)
+			return res, fmt.Errorf("%s does not match the pattern 'FileId-BlockSize'", fileInfo.Name())
 		}
 		id, err := strconv.ParseInt(twoParts[0], 10, 31)
 		if err != nil {
@@ -44,6 +49,9 @@ func NewHPFile(blockSize int, dirName string) (HPFile, error) {
 		}
 		idList = append(idList, int(id))
 		size, err := strconv.ParseInt(twoParts[1], 10, 31)
+		if err != nil {
+			return res, err
+		}
 		if int64(blockSize) != size {
 			return res, fmt.Errorf("Invalid Size! %d!=%d", size, blockSize)
 		}
@@ -51,7 +59,7 @@ func NewHPFile(blockSize int, dirName string) (HPFile, error) {
 	for _, id := range idList {
 		fname := fmt.Sprintf("%s/%d-%d", dirName, id, blockSize)
 		var err error
-		if id == res.largestID { // will write to this latest file
+		if id == res.largestID && !readOnly { // will write to this latest file
 			res.fileMap[id], err = os.OpenFile(fname, os.O_RDWR, 0600)
 		} else {
 			res.fileMap[id], err = os.Open(fname)
@@ -60,23 +68,91 @@ func NewHPFile(blockSize int, dirName string) (HPFile, error) {
 			return res, err
 		}
 	}
-	return res, nil
+	if len(idList) == 0 {
+		return res, fmt.Errorf("No block file in %s", dirName)
+	}
+	res.latestSize, err = res.blockFileSize(res.largestID)
+	return res, err
+}
+
+// Create the first block file in an empty directory. It begins with 'header', which
+// occupies the position 0
+func CreateHPFile(blockSize int, dirName string, header [][]byte) (HPFile, error) {
+	if blockSize%16 != 0 {
+		return HPFile{}, fmt.Errorf("Block size %d is not a multiple of 16", blockSize)
+	}
+	fname := fmt.Sprintf("%s/%d-%d", dirName, 0, blockSize)
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return HPFile{}, err
+	}
+	for _, buf := range header {
+		_, err = f.Write(buf)
+		if err != nil {
+			f.Close()
+			return HPFile{}, err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return HPFile{}, err
+	}
+	return NewHPFile(blockSize, dirName, false)
 }
 
 func (hpf *HPFile) Size() int64 {
-	f := hpf.fileMap[hpf.largestID]
-	size, err := f.Seek(0, os.SEEK_END)
+	hpf.mtx.RLock()
+	defer hpf.mtx.RUnlock()
+	return hpf.size()
+}
+
+func (hpf *HPFile) size() int64 {
+	return int64(hpf.largestID)*int64(hpf.blockSize) + hpf.latestSize
+}
+
+// Return the size of the file of block 'id'. It can be larger than blockSize because the last
+// slot in a block may overflow to the next block
+func (hpf *HPFile) blockFileSize(id int) (int64, error) {
+	hpf.mtx.RLock()
+	f, ok := hpf.fileMap[id]
+	hpf.mtx.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("Can not find the file with id=%d", id)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Change the size to 'size', which must be inside the latest block. The latest file is
+// truncated or extended with zero bytes
+func (hpf *HPFile) Truncate(size int64) error {
+	hpf.mtx.Lock()
+	defer hpf.mtx.Unlock()
+	blockStart := int64(hpf.largestID) * int64(hpf.blockSize)
+	if size < blockStart {
+		return fmt.Errorf("Can not truncate to %d, which is before the latest block %d", size, blockStart)
+	}
+	err := hpf.fileMap[hpf.largestID].Truncate(size - blockStart)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	return int64(hpf.largestID)*int64(hpf.blockSize) + size
+	hpf.latestSize = size - blockStart
+	return nil
 }
 
 func (hpf *HPFile) Sync() error {
-	return hpf.fileMap[hpf.largestID].Sync()
+	hpf.mtx.RLock()
+	f := hpf.fileMap[hpf.largestID]
+	hpf.mtx.RUnlock()
+	return f.Sync()
 }
 
 func (hpf *HPFile) Close() error {
+	hpf.mtx.Lock()
+	defer hpf.mtx.Unlock()
 	for _, file := range hpf.fileMap {
 		err := file.Close()
 		if err != nil {
@@ -89,7 +165,9 @@ func (hpf *HPFile) Close() error {
 func (hpf *HPFile) ReadAt(buf []byte, off int64) error {
 	fileID := off / int64(hpf.blockSize)
 	pos := off % int64(hpf.blockSize)
+	hpf.mtx.RLock()
 	f, ok := hpf.fileMap[int(fileID)]
+	hpf.mtx.RUnlock()
 	if !ok {
 		return fmt.Errorf("Can not find the file with id=%d (%d/%d)", fileID, off, hpf.blockSize)
 	}
@@ -98,68 +176,99 @@ func (hpf *HPFile) ReadAt(buf []byte, off int64) error {
 }
 
 func (hpf *HPFile) Append(bufList [][]byte) (int64, error) {
+	// reserve the range at the end, which is written without locking 'mtx'
+	hpf.mtx.RLock()
 	f := hpf.fileMap[hpf.largestID]
-	size, err := f.Seek(0, os.SEEK_END)
-	if err != nil {
-		return 0, err
-	}
-	totalLen := 0
+	startPos := hpf.size()
+	size := hpf.latestSize
+	hpf.mtx.RUnlock()
 	for _, buf := range bufList {
-		_, err = f.Write(buf)
+		_, err := f.WriteAt(buf, size)
 		if err != nil {
 			return 0, err
 		}
-		totalLen += len(buf)
+		size += int64(len(buf))
 	}
-	overflowByteCount := size + int64(totalLen) - int64(hpf.blockSize)
+	hpf.mtx.Lock()
+	hpf.latestSize = size
+	hpf.mtx.Unlock()
+	overflowByteCount := size - int64(hpf.blockSize)
 	if overflowByteCount >= 0 {
-		f.Sync()
-		hpf.largestID++
-		fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, hpf.largestID, hpf.blockSize)
-		f, err = os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0600)
+		err := f.Sync()
+		if err != nil {
+			return 0, err
+		}
+		err = hpf.addBlock(overflowByteCount)
 		if err != nil {
 			return 0, err
 		}
-		if overflowByteCount != 0 {
-			zeroBytes := make([]byte, overflowByteCount)
-			_, err = f.Write(zeroBytes)
-			if err != nil {
-				return 0, err
-			}
+	}
+	return startPos, nil
+}
+
+// Start a new latest block whose leading 'paddingSize' bytes are zero, because they
+// have been occupied by the overflowed tail of the previous block
+func (hpf *HPFile) addBlock(paddingSize int64) error {
+	id := hpf.largestID + 1
+	fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, id, hpf.blockSize)
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if paddingSize != 0 {
+		zeroBytes := make([]byte, paddingSize)
+		_, err = f.Write(zeroBytes)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	hpf.mtx.Lock()
+	hpf.largestID = id
+	hpf.fileMap[id] = f
+	hpf.latestSize = paddingSize
+	hpf.mtx.Unlock()
+	return nil
+}
+
+// Return the start of the first block which is not pruned
+func (hpf *HPFile) StartPos() int64 {
+	hpf.mtx.RLock()
+	defer hpf.mtx.RUnlock()
+	minID := hpf.largestID
+	for id := range hpf.fileMap {
+		if minID > id {
+			minID = id
 		}
-		hpf.fileMap[hpf.largestID] = f
-		size = overflowByteCount
 	}
-	return int64(hpf.largestID*hpf.blockSize) + size, nil
+	return int64(minID) * int64(hpf.blockSize)
 }
 
-//func (hpf *HPFile) StartPos() int64 {
-//	minID := hpf.largestID
-//	for id := range hpf.fileMap {
-//		if minID > id {
-//			minID = id
-//		}
-//	}
-//	return int64(minID)*int64(hpf.blockSize)
-//}
+func (hpf *HPFile) BlockCount() int {
+	hpf.mtx.RLock()
+	defer hpf.mtx.RUnlock()
+	return len(hpf.fileMap)
+}
 
 func (hpf *HPFile) PruneHead(off int64) error {
 	fileID := off / int64(hpf.blockSize)
-	var idList []int
+	hpf.mtx.Lock()
+	var files []*os.File
 	for id, f := range hpf.fileMap {
 		if id >= int(fileID) {
 			continue
 		}
+		files = append(files, f)
+		delete(hpf.fileMap, id)
+	}
+	hpf.mtx.Unlock()
+	// a reader which got the file before it was removed from fileMap fails to read it
+	for _, f := range files {
 		err := f.Close()
 		if err != nil {
 			return err
 		}
-		idList = append(idList, id)
-	}
-	for _, id := range idList {
-		delete(hpf.fileMap, id)
-		fname := fmt.Sprintf("%s/%d-%d", hpf.dirName, id, hpf.blockSize)
-		err := os.Remove(fname)
+		err = os.Remove(f.Name())
 		if err != nil {
 			return err
 		}
@@ -3,118 +3,316 @@ package rabbitkv
 import (
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"io/ioutil"
-	"strconv"
 	"sort"
+	"strconv"
 )
 
 const (
 	EffectiveFileCount = 257
-	EntryLengthInLog = 10
+	EntryLengthInLog   = 10
+
+	// The kinds of control entries, which are stored in the value field
+	batchBeginEntry  = 1
+	batchCommitEntry = 2
+
+	// The checksum of a control entry is inverted to distinguish it from a normal one
+	controlEntryMask = 0xFF
+	maxControlArg    = (1 << 40) - 1
 )
 
+// An entry in the index log, which is either a normal one recording a KV32 pair, or a control one
+// marking batch boundaries. For a control entry, key64 is its argument and value32 is its kind
+type logEntry struct {
+	key64   uint64
+	value32 uint32
+	control bool
+}
+
 type IndexLogger struct {
-	fileIDList []int64
-	dirName    string
-	outFile    *os.File
+	fileIDList    []int64
+	dirName       string
+	outFile       *os.File
+	retainedCount int
 }
 
-func getFileSize(f *os.File) int64 {
-	size, err := f.Seek(0, os.SEEK_END)
+func getFileSize(f *os.File) (int64, error) {
+	info, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	return size
+	return info.Size(), nil
 }
 
-func (ilog *IndexLogger) SizeOfLastFile() int64 {
+func (ilog *IndexLogger) SizeOfLastFile() (int64, error) {
 	return getFileSize(ilog.outFile)
 }
 
+// Return the sizes of the retained files, from the oldest to the latest
+func (ilog *IndexLogger) FileSizes() ([]int64, error) {
+	res := make([]int64, 0, len(ilog.fileIDList))
+	for _, id := range ilog.fileIDList {
+		info, err := os.Stat(filepath.Join(ilog.dirName, fmt.Sprintf("%d", id)))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, info.Size())
+	}
+	return res, nil
+}
+
+// Only the shard index (the highest byte) and the lowest 32 bits of key64 are used by
+// Hash3Bundle, so only these 40 bits are recorded in the log
+func packKey64(key64 uint64) uint64 {
+	return ((key64 >> 56) << 32) | uint64(uint32(key64))
+}
+
+func unpackKey64(key40 uint64) uint64 {
+	return ((key40 >> 32) << 56) | uint64(uint32(key40))
+}
+
 func (ilog *IndexLogger) Write(key64 uint64, value32 uint32) (n int, err error) {
-	var buf [3+EntryLengthInLog]byte
-	binary.BigEndian.PutUint64(buf[0:8], key64)
+	return ilog.writeEntry(packKey64(key64), value32, 0)
+}
+
+// Write a control entry of 'kind' with an argument, which must fit in 40 bits
+func (ilog *IndexLogger) WriteControl(kind uint32, arg uint64) (n int, err error) {
+	if arg > maxControlArg {
+		panic("Argument is too large")
+	}
+	return ilog.writeEntry(arg, kind, controlEntryMask)
+}
+
+func (ilog *IndexLogger) writeEntry(key40 uint64, value32 uint32, mask byte) (n int, err error) {
+	var buf [3 + EntryLengthInLog]byte
+	binary.BigEndian.PutUint64(buf[0:8], key40)
 	binary.BigEndian.PutUint32(buf[8:12], value32)
-	for i:=3; i<12; i++ { // the first three bytes are ingored
+	for i := 3; i < 12; i++ { // the first three bytes are ingored
 		buf[12] ^= buf[i]
 	}
+	buf[12] ^= mask
 	return ilog.outFile.Write(buf[3:])
 }
 
 func (ilog *IndexLogger) Sync() error {
-	return ilog.Sync()
+	return ilog.outFile.Sync()
+}
+
+func (ilog *IndexLogger) Close() error {
+	return ilog.outFile.Close()
 }
 
 func (ilog *IndexLogger) AddNewFile(hb *Hash3Bundle) (err error) {
 	if ilog.outFile != nil {
+		// flush it because only the latest file is flushed by Sync
+		if err = ilog.outFile.Sync(); err != nil {
+			return
+		}
 		ilog.outFile.Close()
 	}
-	largestID := ilog.fileIDList[len(ilog.fileIDList)-1]
-	fname := filepath.Join(ilog.dirName, fmt.Sprintf("%d", largestID))
-	ilog.outFile, err = os.OpenFile(fname, os.O_RDWR, 0700)
+	largestID := ilog.fileIDList[len(ilog.fileIDList)-1] + 1
+	ilog.outFile, err = createLogFile(ilog.dirName, largestID)
 	if err != nil {
 		return
 	}
 	ilog.fileIDList = append(ilog.fileIDList, largestID)
 	// Dump a Hash3 at the beginning
-	arrIdx := largestID%256
-	hb.arr[arrIdx].Scan(func(key uint32, value uint32) {
-		key64 := (uint64(arrIdx)<<32)|uint64(key)
-		ilog.Write(key64, value)
+	arrIdx := largestID % 256
+	hb.scanShard(int(arrIdx), func(key uint32, value uint32) bool {
+		key64 := (uint64(arrIdx) << 56) | uint64(key)
+		_, err = ilog.Write(key64, value)
+		return err == nil
 	})
+	if err != nil {
+		return
+	}
 	//remove old and useless log files
+	removed := 0
 	for _, fileID := range ilog.fileIDList {
-		if fileID > largestID - EffectiveFileCount {
+		if fileID > largestID-int64(ilog.retainedCount) {
 			break
 		}
-		fname = filepath.Join(ilog.dirName, fmt.Sprintf("%d", fileID))
+		fname := filepath.Join(ilog.dirName, fmt.Sprintf("%d", fileID))
 		err = os.Remove(fname)
 		if err != nil {
 			return
 		}
+		removed++
 	}
+	ilog.fileIDList = ilog.fileIDList[removed:]
 	return
 }
 
-func scanLogsInFile(f *os.File, fn func(key uint64, value uint32)) {
-	var buf [3+EntryLengthInLog]byte
-	size := getFileSize(f)
+func createLogFile(dirName string, id int64) (*os.File, error) {
+	fname := filepath.Join(dirName, fmt.Sprintf("%d", id))
+	return os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+// Scan the entries in 'f' and return the length of the valid ones. When 'lenient' is true,
+// the scanning stops at an incomplete or corrupt entry, otherwise ErrCorruptIndexLog is returned
+func scanLogsInFile(f *os.File, lenient bool, fn func(off int64, e logEntry) error) (int64, error) {
+	var buf [3 + EntryLengthInLog]byte
+	size, err := getFileSize(f)
+	if err != nil {
+		return 0, err
+	}
 	for off := int64(0); off < size; off += EntryLengthInLog {
+		if off+EntryLengthInLog > size {
+			if lenient {
+				return off, nil
+			}
+			return off, fmt.Errorf("%w: incomplete entry at %d of %s", ErrCorruptIndexLog, off, f.Name())
+		}
 		_, err := f.ReadAt(buf[3:], off)
 		if err != nil {
-			panic(err)
+			return off, err
 		}
 		cksum := byte(0)
-		for i:=3; i<12; i++ { // the first three bytes are ingored
+		for i := 3; i < 12; i++ { // the first three bytes are ingored
 			cksum ^= buf[i]
 		}
-		if cksum != buf[12] {
-			panic("Checksum Error")
+		var e logEntry
+		if cksum == buf[12] {
+			e.key64 = unpackKey64(binary.BigEndian.Uint64(buf[0:8]))
+		} else if cksum == buf[12]^controlEntryMask {
+			e.key64 = binary.BigEndian.Uint64(buf[0:8])
+			e.control = true
+		} else {
+			if lenient {
+				return off, nil
+			}
+			return off, fmt.Errorf("%w: checksum error at %d of %s", ErrCorruptIndexLog, off, f.Name())
+		}
+		e.value32 = binary.BigEndian.Uint32(buf[8:12])
+		err = fn(off, e)
+		if err != nil {
+			return off, fmt.Errorf("%w at %d of %s", err, off, f.Name())
 		}
-		key64 := binary.BigEndian.Uint64(buf[0:8])
-		value32 := binary.BigEndian.Uint32(buf[8:12])
-		fn(key64, value32)
 	}
+	return size, nil
 }
 
-func (ilog *IndexLogger) Scan(fn func(key uint64, value uint32)) {
-	for _, id := range ilog.fileIDList {
+// Replay the entries in order. The entries between a batchBeginEntry and a batchCommitEntry
+// are buffered and only take effect when the batchCommitEntry is met. 'fn' is called with the
+// sequence number of the batch, or zero for the entries out of batches
+type logReplayer struct {
+	fn       func(key uint64, value uint32, seq uint64)
+	onCommit func(seq uint64)
+	pending  []logEntry
+	inBatch  bool
+	beginOff int64
+	seq      uint64
+}
+
+func (r *logReplayer) feed(off int64, e logEntry) error {
+	if !e.control {
+		if r.inBatch {
+			r.pending = append(r.pending, e)
+		} else {
+			r.fn(e.key64, e.value32, 0)
+		}
+		return nil
+	}
+	switch e.value32 {
+	case batchBeginEntry:
+		if r.inBatch {
+			return fmt.Errorf("%w: batch %d is not committed", ErrCorruptIndexLog, r.seq)
+		}
+		r.inBatch, r.beginOff, r.seq = true, off, e.key64
+		r.pending = r.pending[:0]
+	case batchCommitEntry:
+		if !r.inBatch || r.seq != e.key64 {
+			return fmt.Errorf("%w: batch %d is not begun", ErrCorruptIndexLog, e.key64)
+		}
+		for _, p := range r.pending {
+			r.fn(p.key64, p.value32, r.seq)
+		}
+		r.inBatch = false
+		r.onCommit(r.seq)
+	default:
+		return fmt.Errorf("%w: unknown control entry %d", ErrCorruptIndexLog, e.value32)
+	}
+	return nil
+}
+
+// Scan all the entries of committed batches and the ones out of batches in the retained files.
+// 'fn' is called with the sequence number of the batch which an entry belongs to, or zero if
+// it is out of batches. 'onCommit' is called with the sequence number of each committed batch,
+// after 'fn' is called for all of its entries, and 'onFile' is called with the ID of each file
+// before its entries. When 'lenientTail' is true, the incomplete or corrupt entries and the
+// uncommitted batch at the end of the last file are ignored
+func (ilog *IndexLogger) Scan(lenientTail bool, fn func(key uint64, value uint32, seq uint64),
+	onCommit func(seq uint64), onFile func(id int64)) error {
+	r := &logReplayer{fn: fn, onCommit: onCommit}
+	for i, id := range ilog.fileIDList {
+		onFile(id)
 		fname := filepath.Join(ilog.dirName, fmt.Sprintf("%d", id))
 		f, err := os.Open(fname)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		scanLogsInFile(f, fn)
+		isLast := i == len(ilog.fileIDList)-1
+		_, err = scanLogsInFile(f, lenientTail && isLast, r.feed)
 		f.Close()
+		if err != nil {
+			return err
+		}
+		if r.inBatch && !(lenientTail && isLast) {
+			return fmt.Errorf("%w: batch %d is not committed in %s", ErrCorruptIndexLog, r.seq, fname)
+		}
 	}
+	return nil
 }
 
-func NewIndexLogger(dirName string) (IndexLogger, error) {
+// Truncate the last file to remove the incomplete or corrupt entries and the uncommitted
+// batch at its end, which are left by a crash. The entries of the slots which are 'lost' are
+// also removed, with the batches they belong to, because new slots will be appended at the same
+// positions. The slots are appended in order and each entry is written after its slot, so these
+// entries are the ones after the last entry of a slot which is not lost. The entries of the
+// pruned slots before them also look lost, but they are followed by the entries of newer slots
+func (ilog *IndexLogger) RecoverTail(lost func(value32 uint32) bool) error {
+	r := &logReplayer{fn: func(uint64, uint32, uint64) {}, onCommit: func(uint64) {}}
+	cut := int64(-1)
+	validSize, err := scanLogsInFile(ilog.outFile, true, func(off int64, e logEntry) error {
+		if !e.control && e.value32 != 0 {
+			if !lost(e.value32) {
+				cut = -1
+			} else if cut < 0 && r.inBatch {
+				cut = r.beginOff
+			} else if cut < 0 {
+				cut = off
+			}
+		}
+		return r.feed(off, e)
+	})
+	if err != nil {
+		return err
+	}
+	if r.inBatch && r.beginOff < validSize {
+		validSize = r.beginOff
+	}
+	if cut >= 0 && cut < validSize {
+		validSize = cut
+	}
+	size, err := getFileSize(ilog.outFile)
+	if err != nil || validSize == size {
+		return err
+	}
+	if err = ilog.outFile.Truncate(validSize); err != nil {
+		return err
+	}
+	return ilog.outFile.Sync()
+}
+
+// Open the index-log files in dirName, keeping at most 'retainedCount' files during rotation.
+// When 'readOnly' is true, the last file is not opened for writing
+func NewIndexLogger(dirName string, retainedCount int, readOnly bool) (IndexLogger, error) {
 	res := IndexLogger{
-		fileIDList: make([]int64, EffectiveFileCount),
-		dirName:    dirName,
+		fileIDList:    make([]int64, 0, retainedCount),
+		dirName:       dirName,
+		retainedCount: retainedCount,
 	}
 	fileInfoList, err := ioutil.ReadDir(dirName)
 	if err != nil {
@@ -133,6 +331,24 @@ func NewIndexLogger(dirName string) (IndexLogger, error) {
 	sort.Slice(res.fileIDList, func(i, j int) bool {
 		return res.fileIDList[i] < res.fileIDList[j]
 	})
-	return res, nil
+	if len(res.fileIDList) == 0 {
+		return res, fmt.Errorf("No index-log file in %s", dirName)
+	}
+	largestID := res.fileIDList[len(res.fileIDList)-1]
+	if readOnly {
+		res.outFile, err = os.Open(filepath.Join(dirName, fmt.Sprintf("%d", largestID)))
+	} else {
+		res.outFile, err = createLogFile(dirName, largestID)
+	}
+	return res, err
 }
 
+// Create the first index-log file in an empty directory
+func CreateIndexLogger(dirName string, retainedCount int) (IndexLogger, error) {
+	f, err := createLogFile(dirName, 0)
+	if err != nil {
+		return IndexLogger{}, err
+	}
+	f.Close()
+	return NewIndexLogger(dirName, retainedCount, false)
+}
@@ -0,0 +1,83 @@
+package rabbitkv
+
+// Iterator visits the keys in byte order. The set of visited keys is fixed when the iterator
+// is created, while the values are read when the iterator reaches them, so the keys deleted
+// after the creation are skipped
+type Iterator struct {
+	get    func(key []byte) ([]byte, error)
+	cursor *treapCursor
+	value  []byte
+	err    error
+}
+
+// Return an iterator over the keys in [start, end). A nil 'start' means the smallest key and
+// a nil 'end' means no upper bound. Options.OrderedIndex must be enabled
+func (rkv *RabbitKV) Iterator(start, end []byte) (*Iterator, error) {
+	rkv.mtx.RLock()
+	if rkv.isClosed {
+		rkv.mtx.RUnlock()
+		return nil, ErrClosed
+	}
+	if !rkv.opts.OrderedIndex {
+		rkv.mtx.RUnlock()
+		return nil, ErrNoOrderedIndex
+	}
+	iter := &Iterator{
+		get:    rkv.Get,
+		cursor: newTreapCursor(rkv.orderedRoot, start, end),
+	}
+	rkv.mtx.RUnlock()
+	iter.loadValue() // Get locks mtx by itself
+	return iter, nil
+}
+
+// Return an iterator over the keys which begin with 'prefix'
+func (rkv *RabbitKV) PrefixIterator(prefix []byte) (*Iterator, error) {
+	return rkv.Iterator(prefix, prefixEnd(prefix))
+}
+
+// Return the smallest key larger than all the keys with 'prefix', or nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for len(end) > 0 {
+		if end[len(end)-1] != 0xFF {
+			end[len(end)-1]++
+			return end
+		}
+		end = end[:len(end)-1]
+	}
+	return nil
+}
+
+// Read the value of the current key, skipping the deleted keys
+func (iter *Iterator) loadValue() {
+	for iter.err == nil && iter.cursor.Valid() {
+		iter.value, iter.err = iter.get(iter.cursor.Key())
+		if iter.value != nil {
+			return
+		}
+		iter.cursor.Next()
+	}
+}
+
+// Valid returns false when the iteration is finished or an error happens
+func (iter *Iterator) Valid() bool {
+	return iter.err == nil && iter.cursor.Valid()
+}
+
+func (iter *Iterator) Next() {
+	iter.cursor.Next()
+	iter.loadValue()
+}
+
+func (iter *Iterator) Key() []byte {
+	return append([]byte{}, iter.cursor.Key()...)
+}
+
+func (iter *Iterator) Value() []byte {
+	return iter.value
+}
+
+func (iter *Iterator) Error() error {
+	return iter.err
+}
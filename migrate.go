@@ -0,0 +1,34 @@
+package rabbitkv
+
+// Upgrade the RabbitKV in 'dir' to FormatVersion and return the version before upgrading. If
+// 'dstDir' is empty, it is upgraded in place. Otherwise a checkpoint is written into 'dstDir'
+// and upgraded there, leaving 'dir' in its version. The RabbitKV in 'dir' must not be in use.
+// FormatVersion is the only version so far, so nothing is converted yet, and the versions this
+// library does not understand are refused with ErrUnsupportedFormat
+func Migrate(dir, dstDir string) (uint32, error) {
+	var mi MetaInfo
+	if err := readMetaFile(newDirLayout(dir).metaFile, &mi); err != nil {
+		return 0, err
+	}
+	if err := checkFormatVersion(mi.formatVersion); err != nil {
+		return mi.formatVersion, err
+	}
+	if dstDir == "" {
+		return mi.formatVersion, nil
+	}
+	// opening it recovers the incomplete tails left by a crash, including the one of the change
+	// log, which is copied into the checkpoint
+	hasChangeLog, err := changeLogExists(newDirLayout(dir).clDirName)
+	if err != nil {
+		return mi.formatVersion, err
+	}
+	rkv, err := Open(dir, &Options{GCInterval: -1, ChangeLog: hasChangeLog})
+	if err != nil {
+		return mi.formatVersion, err
+	}
+	err = rkv.Checkpoint(dstDir)
+	if e := rkv.Close(); err == nil {
+		err = e
+	}
+	return mi.formatVersion, err
+}
@@ -0,0 +1,56 @@
+package rabbitkv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096, ChangeLog: true})
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("key"), []byte("value")))
+	require.NoError(t, rkv.Close())
+
+	// already in the current version
+	from, err := Migrate(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(FormatVersion), from)
+
+	// migrated into a new directory with the change log, leaving the old one unchanged
+	dstDir := filepath.Join(tempDir(t), "dst")
+	defer os.RemoveAll(filepath.Dir(dstDir))
+	from, err = Migrate(dir, dstDir)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(FormatVersion), from)
+	rkv, err = Open(dstDir, &Options{ChangeLog: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(FormatVersion), rkv.mi.formatVersion)
+	assert.Equal(t, "value", getString(t, rkv, "key"))
+	require.NoError(t, rkv.Set([]byte("key2"), []byte("value2")))
+	require.NoError(t, rkv.Close())
+	rkv, err = Open(dir, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, "", getString(t, rkv, "key2"))
+	require.NoError(t, rkv.Close())
+
+	// the versions not written by this library can be neither opened nor migrated
+	metaFile := newDirLayout(dir).metaFile
+	for _, version := range []uint32{0, FormatVersion + 1} {
+		var mi MetaInfo
+		require.NoError(t, readMetaFile(metaFile, &mi))
+		mi.formatVersion = version
+		require.NoError(t, writeMetaFile(metaFile, &mi, os.O_RDWR))
+		_, err = Open(dir, nil)
+		assert.True(t, errors.Is(err, ErrUnsupportedFormat))
+		_, err = Migrate(dir, "")
+		assert.True(t, errors.Is(err, ErrUnsupportedFormat))
+	}
+}
@@ -0,0 +1,203 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mmcloughlin/meow"
+)
+
+const (
+	HPFileDirName    = "hpfile"
+	IndexDirName     = "index"
+	MetaFileName     = "meta"
+	ChangeLogDirName = "changelog"
+
+	DefaultBlockSize         = 64 * 1024 * 1024
+	DefaultIndexRotateRatio  = 4
+	DefaultGCMinActiveRatio  = 0.5
+	DefaultGCStepBytes       = 1024 * 1024
+	DefaultGCStepSlots       = 1024
+	DefaultGCInterval        = time.Second
+	DefaultGCStepPause       = 10 * time.Millisecond
+	DefaultChangeLogFileSize = 64 * 1024 * 1024
+)
+
+type syncMode int
+
+const (
+	syncOnBatch syncMode = iota
+	syncNone
+	syncEveryWrite
+	syncInterval
+)
+
+// SyncPolicy decides when the HPFile and the index log are flushed to the disk. The concurrent
+// writers which need flushing share one flush (group commit)
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+}
+
+var (
+	// Flush before Batch.Close returns, single Set/Delete are not flushed
+	SyncOnBatch = SyncPolicy{mode: syncOnBatch}
+	// Never flush explicitly, leave it to the OS
+	SyncNone = SyncPolicy{mode: syncNone}
+	// Flush before Batch.Close, Set and Delete return
+	SyncEveryWrite = SyncPolicy{mode: syncEveryWrite}
+)
+
+// Flush periodically in the background, and the writes do not wait for flushing. At most the
+// writes in the last period 'd' are lost in a crash
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncInterval, interval: d}
+}
+
+func (p SyncPolicy) String() string {
+	switch p.mode {
+	case syncOnBatch:
+		return "SyncOnBatch"
+	case syncNone:
+		return "SyncNone"
+	case syncEveryWrite:
+		return "SyncEveryWrite"
+	default:
+		return fmt.Sprintf("SyncInterval(%s)", p.interval)
+	}
+}
+
+type Options struct {
+	// Size of each HPFile block, must be a multiple of 16.
+	// Only used when creating a store, an existing store keeps its own block size
+	BlockSize int
+	// Seed of the key hash. Only used when creating a store, zero means a random one
+	Seed uint64
+	// A new index-log file is started when the last one is larger than
+	// IndexRotateRatio times of the estimated bytes needed to dump a Hash3
+	IndexRotateRatio int64
+	// How many index-log files are retained, must be larger than 256, such that
+	// every Hash3 has been dumped at least once in the retained files
+	RetainedLogFiles int
+	Sync             SyncPolicy
+	// Open the files read-only, all the modifications are refused
+	ReadOnly bool
+	// Maintain an in-memory ordered index of all the keys, which is needed by Iterator and
+	// PrefixIterator. It is rebuilt by scanning the active slots in the HPFile when opened
+	OrderedIndex bool
+	// When larger than zero, the versioned mode is enabled: each committed batch is a version
+	// numbered by its sequence number, and the latest KeepVersions versions can be read by
+	// GetAtVersion, whose slots are not pruned by garbage collection. A single Set or Delete
+	// is committed as a batch of its own. It should be enabled since the creation of a store,
+	// because the writes made when it is disabled are not versioned
+	KeepVersions uint64
+	// Record the changes of each committed batch in the change log, which can be read by
+	// Subscribe. A single Set or Delete is committed as a batch of its own. Once enabled, it
+	// cannot be disabled, and Open returns ErrChangeLogRequired unless ReadOnly is true
+	ChangeLog bool
+	// A new change-log file is started when the latest one is larger than this size
+	ChangeLogFileSize int64
+	// How many change-log files are retained, zero means all of them
+	RetainedChangeLogFiles int
+	// Garbage collection is needed when activeByteCount/(HPFile.Size()-nextGcPosition) is below
+	// this ratio, i.e. the active slots take a too small part of the slots not collected yet.
+	// Zero means the default one, and a negative one means it is never needed, such that only
+	// the explicit GabageCollect calls collect the garbage
+	GCMinActiveRatio float64
+	// At most so many bytes and slots are scanned by one step of garbage collection
+	GCStepBytes int64
+	GCStepSlots int64
+	// How often the background garbage collector checks whether garbage collection is needed.
+	// A negative one disables the background garbage collector
+	GCInterval time.Duration
+	// The background garbage collector sleeps so long between two steps, such that the
+	// foreground writes are not starved. A negative one means no sleeping
+	GCStepPause time.Duration
+
+	// Hash a key into 64 bits, only replaced by tests to force collisions
+	keyHasher func(seed uint64, key []byte) uint64
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		BlockSize:         DefaultBlockSize,
+		IndexRotateRatio:  DefaultIndexRotateRatio,
+		RetainedLogFiles:  EffectiveFileCount,
+		Sync:              SyncOnBatch,
+		GCMinActiveRatio:  DefaultGCMinActiveRatio,
+		GCStepBytes:       DefaultGCStepBytes,
+		GCStepSlots:       DefaultGCStepSlots,
+		GCInterval:        DefaultGCInterval,
+		GCStepPause:       DefaultGCStepPause,
+		ChangeLogFileSize: DefaultChangeLogFileSize,
+		keyHasher:         meow.Checksum64,
+	}
+}
+
+// Return a copy of opts whose zero-valued fields are filled with the default values
+func (opts *Options) withDefaults() (*Options, error) {
+	res := DefaultOptions()
+	if opts == nil {
+		return res, nil
+	}
+	def := *res
+	*res = *opts
+	if res.BlockSize == 0 {
+		res.BlockSize = def.BlockSize
+	}
+	if res.IndexRotateRatio == 0 {
+		res.IndexRotateRatio = def.IndexRotateRatio
+	}
+	if res.RetainedLogFiles == 0 {
+		res.RetainedLogFiles = def.RetainedLogFiles
+	}
+	if res.GCMinActiveRatio == 0 {
+		res.GCMinActiveRatio = def.GCMinActiveRatio
+	}
+	if res.GCStepBytes == 0 {
+		res.GCStepBytes = def.GCStepBytes
+	}
+	if res.GCStepSlots == 0 {
+		res.GCStepSlots = def.GCStepSlots
+	}
+	if res.GCInterval == 0 {
+		res.GCInterval = def.GCInterval
+	}
+	if res.GCStepPause == 0 {
+		res.GCStepPause = def.GCStepPause
+	}
+	if res.ChangeLogFileSize == 0 {
+		res.ChangeLogFileSize = def.ChangeLogFileSize
+	}
+	if res.keyHasher == nil {
+		res.keyHasher = def.keyHasher
+	}
+	if res.BlockSize%16 != 0 {
+		return nil, fmt.Errorf("Block size %d is not a multiple of 16", res.BlockSize)
+	}
+	if res.Sync.mode == syncInterval && res.Sync.interval <= 0 {
+		return nil, fmt.Errorf("Invalid sync interval %s", res.Sync.interval)
+	}
+	if res.RetainedLogFiles <= 256 {
+		return nil, fmt.Errorf("RetainedLogFiles %d is not larger than 256", res.RetainedLogFiles)
+	}
+	return res, nil
+}
+
+// The layout of a RabbitKV under a root directory
+type dirLayout struct {
+	hpfDirName string
+	idxDirName string
+	metaFile   string
+	clDirName  string
+}
+
+func newDirLayout(dir string) dirLayout {
+	return dirLayout{
+		hpfDirName: filepath.Join(dir, HPFileDirName),
+		idxDirName: filepath.Join(dir, IndexDirName),
+		metaFile:   filepath.Join(dir, MetaFileName),
+		clDirName:  filepath.Join(dir, ChangeLogDirName),
+	}
+}
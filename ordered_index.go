@@ -0,0 +1,179 @@
+package rabbitkv
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+)
+
+// An immutable treap holding keys in byte order. Insertion and deletion copy the nodes on
+// the changed path and return a new root, such that an old root is a stable view of keys
+type treapNode struct {
+	key      []byte
+	priority uint64
+	left     *treapNode
+	right    *treapNode
+}
+
+// The priorities are random and unpredictable, such that the keys chosen by the clients cannot
+// unbalance the treap
+var treapRand struct {
+	sync.Mutex
+	rnd *rand.Rand
+}
+
+func init() {
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	treapRand.rnd = rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(buf[:]))))
+}
+
+func newTreapNode(key []byte) *treapNode {
+	treapRand.Lock()
+	priority := treapRand.rnd.Uint64()
+	treapRand.Unlock()
+	return &treapNode{
+		key:      append([]byte{}, key...),
+		priority: priority,
+	}
+}
+
+func (n *treapNode) clone() *treapNode {
+	c := *n
+	return &c
+}
+
+// Split into the nodes whose keys are less than 'key' and the others
+func treapSplit(n *treapNode, key []byte) (*treapNode, *treapNode) {
+	if n == nil {
+		return nil, nil
+	}
+	n = n.clone()
+	if bytes.Compare(n.key, key) < 0 {
+		var r *treapNode
+		n.right, r = treapSplit(n.right, key)
+		return n, r
+	}
+	var l *treapNode
+	l, n.left = treapSplit(n.left, key)
+	return l, n
+}
+
+// Merge two treaps, all the keys in 'l' must be less than the ones in 'r'
+func treapMerge(l, r *treapNode) *treapNode {
+	if l == nil {
+		return r
+	}
+	if r == nil {
+		return l
+	}
+	if l.priority > r.priority {
+		l = l.clone()
+		l.right = treapMerge(l.right, r)
+		return l
+	}
+	r = r.clone()
+	r.left = treapMerge(l, r.left)
+	return r
+}
+
+func treapHas(n *treapNode, key []byte) bool {
+	for n != nil {
+		switch c := bytes.Compare(key, n.key); {
+		case c == 0:
+			return true
+		case c < 0:
+			n = n.left
+		default:
+			n = n.right
+		}
+	}
+	return false
+}
+
+func treapInsert(root *treapNode, key []byte) *treapNode {
+	if treapHas(root, key) {
+		return root
+	}
+	l, r := treapSplit(root, key)
+	return treapMerge(treapMerge(l, newTreapNode(key)), r)
+}
+
+func treapDelete(root *treapNode, key []byte) *treapNode {
+	if !treapHas(root, key) {
+		return root
+	}
+	l, r := treapSplit(root, key)
+	successor := append(append([]byte{}, key...), 0) // the smallest key larger than 'key'
+	_, r = treapSplit(r, successor)
+	return treapMerge(l, r)
+}
+
+// An in-order cursor over a treap, which visits keys in [start, end)
+type treapCursor struct {
+	stack []*treapNode
+	end   []byte
+}
+
+// Seek to the first key not less than 'start', a nil 'start' means the smallest key.
+// A nil 'end' means no upper bound
+func newTreapCursor(root *treapNode, start, end []byte) *treapCursor {
+	c := &treapCursor{end: end}
+	for n := root; n != nil; {
+		if start == nil || bytes.Compare(n.key, start) >= 0 {
+			c.stack = append(c.stack, n)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return c
+}
+
+func (c *treapCursor) Valid() bool {
+	if len(c.stack) == 0 {
+		return false
+	}
+	return c.end == nil || bytes.Compare(c.Key(), c.end) < 0
+}
+
+func (c *treapCursor) Key() []byte {
+	return c.stack[len(c.stack)-1].key
+}
+
+func (c *treapCursor) Next() {
+	n := c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+	for n = n.right; n != nil; n = n.left {
+		c.stack = append(c.stack, n)
+	}
+}
+
+func (rkv *RabbitKV) updateOrderedIndex(key, value []byte) {
+	if !rkv.opts.OrderedIndex {
+		return
+	}
+	if value == nil {
+		rkv.orderedRoot = treapDelete(rkv.orderedRoot, key)
+	} else {
+		rkv.orderedRoot = treapInsert(rkv.orderedRoot, key)
+	}
+}
+
+// Insert the keys in all the active slots to the ordered index
+func (rkv *RabbitKV) buildOrderedIndex() error {
+	start, end := int64(rkv.mi.nextGcPosition), rkv.hpfile.Size()
+	return rkv.ScanSlots(start, end, func(slot Slot, pos uint64, length int) bool {
+		if slot.Empty() || rkv.findSlotAt(rkv.slotKey64(&slot), int64(pos)) == nil {
+			return true
+		}
+		for _, pair := range slot.pairs {
+			rkv.orderedRoot = treapInsert(rkv.orderedRoot, pair.key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,144 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/mmcloughlin/meow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func treapKeys(root *treapNode, start, end []byte) (res []string) {
+	for c := newTreapCursor(root, start, end); c.Valid(); c.Next() {
+		res = append(res, string(c.Key()))
+	}
+	return
+}
+
+func TestTreap(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var root *treapNode
+	var history []*treapNode
+	ref := make(map[string]bool)
+	var refHistory [][]string
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("%03d", r.Intn(500)))
+		if r.Intn(3) == 0 {
+			root = treapDelete(root, key)
+			delete(ref, string(key))
+		} else {
+			root = treapInsert(root, key)
+			ref[string(key)] = true
+		}
+		if i%500 == 0 {
+			history = append(history, root)
+			var keys []string
+			for k := range ref {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			refHistory = append(refHistory, keys)
+		}
+	}
+	var keys []string
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, keys, treapKeys(root, nil, nil))
+	// the old roots are not changed
+	for i, old := range history {
+		assert.Equal(t, refHistory[i], treapKeys(old, nil, nil))
+	}
+
+	var expected []string
+	for _, k := range keys {
+		if k >= "100" && k < "200" {
+			expected = append(expected, k)
+		}
+	}
+	assert.Equal(t, expected, treapKeys(root, []byte("100"), []byte("200")))
+	assert.Equal(t, []byte{1, 3}, prefixEnd([]byte{1, 2, 0xFF}))
+	assert.Nil(t, prefixEnd([]byte{0xFF, 0xFF}))
+}
+
+func treapDepth(n *treapNode) int {
+	if n == nil {
+		return 0
+	}
+	l, r := treapDepth(n.left), treapDepth(n.right)
+	if l < r {
+		l = r
+	}
+	return l + 1
+}
+
+func TestTreapCraftedKeys(t *testing.T) {
+	// the keys whose checksums increase with them, which make a chain if the priority is the checksum
+	const count = 200
+	var root *treapNode
+	for i := 0; i < count; i++ {
+		for nonce := 0; ; nonce++ {
+			key := []byte(fmt.Sprintf("%04d-%d", i, nonce))
+			if meow.Checksum64(0, key)/(math.MaxUint64/count) == uint64(i) {
+				root = treapInsert(root, key)
+				break
+			}
+		}
+	}
+	assert.Equal(t, count, len(treapKeys(root, nil, nil)))
+	assert.True(t, treapDepth(root) < count/4)
+}
+
+func iterKeys(t *testing.T, iter *Iterator, err error) (res []string) {
+	require.NoError(t, err)
+	for ; iter.Valid(); iter.Next() {
+		res = append(res, string(iter.Key())+"="+string(iter.Value()))
+	}
+	require.NoError(t, iter.Error())
+	return
+}
+
+func TestIterator(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	_, err = rkv.Iterator(nil, nil)
+	assert.Equal(t, ErrNoOrderedIndex, err)
+	require.NoError(t, rkv.Set([]byte("b1"), []byte("v")))
+	require.NoError(t, rkv.Close())
+
+	opts := &Options{OrderedIndex: true}
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	for _, k := range []string{"a1", "a2", "b2", "c1", "a3"} {
+		require.NoError(t, rkv.Set([]byte(k), []byte("v")))
+	}
+	require.NoError(t, rkv.Delete([]byte("a2")))
+	iter, err := rkv.Iterator(nil, nil)
+	assert.Equal(t, []string{"a1=v", "a3=v", "b1=v", "b2=v", "c1=v"}, iterKeys(t, iter, err))
+	iter, err = rkv.Iterator([]byte("a2"), []byte("b2"))
+	assert.Equal(t, []string{"a3=v", "b1=v"}, iterKeys(t, iter, err))
+	iter, err = rkv.PrefixIterator([]byte("b"))
+	assert.Equal(t, []string{"b1=v", "b2=v"}, iterKeys(t, iter, err))
+
+	// the deleted keys are skipped
+	iter, err = rkv.PrefixIterator([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, rkv.Delete([]byte("a3")))
+	assert.Equal(t, []string{"a1=v"}, iterKeys(t, iter, err))
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	iter, err = rkv.Iterator(nil, nil)
+	assert.Equal(t, []string{"a1=v", "b1=v", "b2=v", "c1=v"}, iterKeys(t, iter, err))
+	require.NoError(t, rkv.Close())
+}
@@ -1,26 +1,46 @@
 package rabbitkv
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
-	"os"
+	"fmt"
+	"io"
 	"math"
+	"os"
+	"path/filepath"
 	"sync"
-	"encoding/binary"
+	"sync/atomic"
 
 	"github.com/mmcloughlin/meow"
 )
 
-//TODO gc
+const MetaInfoBytes = 256 + 8*5 + 1 + 4 + 4
 
-const MetaInfoBytes = 256+8*3+1+4
+// The version of the on-disk format written by this library, covering the meta file, the slots
+// in HPFile, the index-log entries and the file names. Version 1 is the first one recorded in
+// the meta file: the older layout never wrote a readable meta file, so there is no store to be
+// upgraded from it. In version 1, KV32.Value keeps the lowest 32 bits of pos/16 and the position
+// is decoded in the window after the head of HPFile
+const FormatVersion = 1
+
+// The positions in the retained blocks of HPFile must be less than the head plus PositionWindow
+const PositionWindow = int64(1) << 36
+
+// The writes are refused when the retained blocks take more than PositionWindow-positionReserve
+// bytes, leaving the rest of the window to garbage collection, such that it can always relocate
+// the active slots in the head blocks and then prune them
+const positionReserve = PositionWindow / 16
 
 type MetaInfo struct {
 	allAddrBits     [256]byte // just hints, they are ok to be incorrect
-	nextGcPosition  uint64 // can be less than real value if not closed properly
-	activeByteCount uint64 // need to recover if not closed properly
-	seed            uint64 // constant during lifetime
-	blockSize       uint64 // constant during lifetime
+	nextGcPosition  uint64    // can be less than real value if not closed properly
+	activeByteCount uint64    // need to recover if not closed properly
+	seed            uint64    // constant during lifetime
+	blockSize       uint64    // constant during lifetime
+	lastBatchSeq    uint64    // can be less than real value if not closed properly
 	closed          bool
+	formatVersion   uint32
 }
 
 func (mi *MetaInfo) ToBytes() (res [MetaInfoBytes]byte) {
@@ -33,20 +53,25 @@ func (mi *MetaInfo) ToBytes() (res [MetaInfoBytes]byte) {
 	binary.LittleEndian.PutUint64(res[start:end], mi.seed)
 	start, end = end, end+8
 	binary.LittleEndian.PutUint64(res[start:end], mi.blockSize)
+	start, end = end, end+8
+	binary.LittleEndian.PutUint64(res[start:end], mi.lastBatchSeq)
 	res[end] = 0
 	if mi.closed {
-		res[end] =1
+		res[end] = 1
 	}
+	start, end = end+1, end+5
+	binary.LittleEndian.PutUint32(res[start:end], mi.formatVersion)
 	cksum := meow.Checksum32(0, res[:MetaInfoBytes-4])
 	binary.LittleEndian.PutUint32(res[MetaInfoBytes-4:], cksum)
 	return
 }
 
-func (mi *MetaInfo) FromBytes(bz [MetaInfoBytes]byte) {
-	cksum := meow.Checksum32(0, bz[:MetaInfoBytes-4])
-	if cksum != binary.LittleEndian.Uint32(bz[MetaInfoBytes-4:]) {
-		panic("Checksum Error")
-	}
+func (mi *MetaInfo) FromBytes(bz [MetaInfoBytes]byte) error {
+	return mi.decode(bz[:])
+}
+
+// The fields are decoded even if the checksum is wrong, such that Verify can go on checking
+func (mi *MetaInfo) decode(bz []byte) error {
 	copy(mi.allAddrBits[:], bz[:256])
 	start, end := 256, 264
 	mi.nextGcPosition = binary.LittleEndian.Uint64(bz[start:end])
@@ -56,104 +81,439 @@ func (mi *MetaInfo) FromBytes(bz [MetaInfoBytes]byte) {
 	mi.seed = binary.LittleEndian.Uint64(bz[start:end])
 	start, end = end, end+8
 	mi.blockSize = binary.LittleEndian.Uint64(bz[start:end])
+	start, end = end, end+8
+	mi.lastBatchSeq = binary.LittleEndian.Uint64(bz[start:end])
 	mi.closed = bz[end] != 0
+	start, end = end+1, end+5
+	mi.formatVersion = binary.LittleEndian.Uint32(bz[start:end])
+	cksum := meow.Checksum32(0, bz[:MetaInfoBytes-4])
+	if cksum != binary.LittleEndian.Uint32(bz[MetaInfoBytes-4:]) {
+		return fmt.Errorf("%w: checksum error", ErrCorruptMeta)
+	}
+	return nil
 }
 
 type RabbitKV struct {
+	// The readers lock 'mtx' for reading. A writer locks 'wmtx' to append the slots and write
+	// the index log, and then publishes the new KV32 entries, so the readers are not blocked by
+	// the file writes. The fields read by the readers are changed with 'mtx' locked, except that
+	// a Hash3 shard can be changed with 'mtx' read-locked and the lock of the shard locked, and
+	// mi.activeByteCount is changed atomically. ilog, changes, wrLogCount, writeTicket and
+	// writeErr are accessed with 'wmtx' locked
 	mtx        sync.RWMutex
+	wmtx       sync.Mutex
 	hpfile     HPFile
 	ilog       IndexLogger
 	hb         Hash3Bundle
 	wrLogCount uint64
 	mi         MetaInfo
-	metaFile   string
+	// mi.nextGcPosition when the files were flushed last time. Only this one is saved in the
+	// meta file, because the slots relocated before mi.nextGcPosition may be not flushed yet
+	syncedGcPosition uint64
+	metaFile         string
+	opts             *Options
+	isClosed         bool
+	// The root of the ordered index, only maintained when Options.OrderedIndex is true
+	orderedRoot *treapNode
+	// Once a write fails halfway, the in-memory state may mismatch the files, so all the
+	// following writes are refused and the files are not marked as closed properly, such that
+	// they will be recovered when opened again
+	writeErr error
+
+	// The background goroutines exit when bgStop is closed
+	bgStop     chan struct{}
+	bgStopOnce sync.Once
+	bgWG       sync.WaitGroup
+
+	// Serialize the steps of garbage collection
+	gcMtx sync.Mutex
+	// The error which stopped the background garbage collector
+	gcErr error
+	// Counters of garbage collection since opened
+	gcRelocations    uint64
+	gcRelocatedBytes uint64
+	gcPrunes         uint64
+	gcPrunedBlocks   uint64
+	// The count of live snapshots pinning each position, the slots after it must be retained
+	pins map[int64]int
+	// Only used in the versioned mode
+	history *versionHistory
+	// Increased after each write, such that waitSynced can tell whether it has been flushed
+	writeTicket uint64
+	gs          groupSyncer
+	// Only used when Options.ChangeLog is enabled. changeNotify is closed and replaced
+	// when a batch is committed or the RabbitKV is closed
+	changes      *changeLogger
+	changeNotify chan struct{}
+}
+
+// Close the files. The error which stopped the background garbage collector is returned if
+// there is no other error
+func (rkv *RabbitKV) Close() error {
+	rkv.stopBackground()
+	rkv.wmtx.Lock()
+	defer rkv.wmtx.Unlock()
+	rkv.mtx.Lock()
+	defer rkv.mtx.Unlock()
+	if rkv.isClosed {
+		return ErrClosed
+	}
+	rkv.isClosed = true
+	var err error
+	if !rkv.opts.ReadOnly && rkv.writeErr == nil {
+		err = rkv.sync()
+		if err == nil {
+			rkv.mi.closed = true
+			err = rkv.SaveMetaFile()
+		}
+	}
+	errList := []error{rkv.ilog.Close(), rkv.hpfile.Close(), rkv.gcErr}
+	if rkv.changes != nil {
+		errList = append(errList, rkv.changes.close())
+		close(rkv.changeNotify)
+	}
+	for _, e := range errList {
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Run 'fn' in a goroutine, which must exit when bgStop is closed
+func (rkv *RabbitKV) goBackground(fn func()) {
+	rkv.bgWG.Add(1)
+	go func() {
+		defer rkv.bgWG.Done()
+		fn()
+	}()
+}
+
+// Stop the background goroutines and wait until they exit. It is safe to be called more than once
+func (rkv *RabbitKV) stopBackground() {
+	rkv.bgStopOnce.Do(func() {
+		close(rkv.bgStop)
+	})
+	rkv.bgWG.Wait()
 }
 
-func (rkv *RabbitKV) Close() {
-	rkv.mi.closed = true
-	rkv.SaveMetaFile()
+func (rkv *RabbitKV) SaveMetaFile() error {
+	rkv.mi.allAddrBits = rkv.hb.GetAllAddrBits()
+	mi := rkv.mi
+	mi.nextGcPosition = rkv.syncedGcPosition // can be less than the real value, but never more
+	return writeMetaFile(rkv.metaFile, &mi, os.O_RDWR)
 }
 
-func (rkv *RabbitKV) SaveMetaFile() {
-	f, err := os.OpenFile(rkv.metaFile, os.O_RDWR, 0600)
+// The meta file is written aside, flushed and renamed over the old one, such that a crash leaves
+// either the old one or the new one, and the crash marker of the new one is never lost. As with
+// os.OpenFile, it must exist unless 'flag' has os.O_CREATE, and must not exist if it has os.O_EXCL
+func writeMetaFile(metaFile string, mi *MetaInfo, flag int) error {
+	if flag&os.O_CREATE == 0 {
+		if _, err := os.Stat(metaFile); err != nil {
+			return err
+		}
+	}
+	tmpFile := metaFile + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bz := mi.ToBytes()
+	_, err = f.Write(bz[:])
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil && flag&os.O_EXCL != 0 {
+		err = os.Link(tmpFile, metaFile) // fails if it exists
+	} else if err == nil {
+		err = os.Rename(tmpFile, metaFile)
+	}
 	if err != nil {
-		panic(err)
+		os.Remove(tmpFile)
+		return err
 	}
-	bz := rkv.mi.ToBytes()
-	f.Write(bz[:])
-	f.Close()
+	if flag&os.O_EXCL != 0 {
+		if err = os.Remove(tmpFile); err != nil {
+			return err
+		}
+	}
+	return syncFile(filepath.Dir(metaFile)) // flush the renamed directory entry
 }
 
-func LoadRabbitKV(hpfDirName, idxDirName, metaFile string) (res *RabbitKV, err error) {
-	res = &RabbitKV{metaFile: metaFile}
-	f, err := os.Open(metaFile)
+// Create a brand-new RabbitKV under 'dir', which must not contain another RabbitKV.
+// The HPFile blocks, index-log files and meta file are stored in 'dir/hpfile',
+// 'dir/index' and 'dir/meta', respectively. A nil 'opts' means DefaultOptions()
+func CreateRabbitKV(dir string, opts *Options) (*RabbitKV, error) {
+	opts, err := opts.withDefaults()
 	if err != nil {
-		return
+		return nil, err
 	}
-	var buf [MetaInfoBytes]byte
-	_, err = f.Read(buf[:])
+	if opts.ReadOnly {
+		return nil, errors.New("Cannot create a read-only RabbitKV")
+	}
+	layout := newDirLayout(dir)
+	if _, err := os.Stat(layout.metaFile); err == nil {
+		return nil, errors.New("RabbitKV already exists in " + dir)
+	}
+	for _, d := range []string{layout.hpfDirName, layout.idxDirName} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	// KV32.Value==0 means invalid, so an empty slot occupies the position 0
+	// to make sure no valid slot can be found there
+	emptySlot := Slot{}
+	header, _ := emptySlot.ToSlicesForDump()
+	hpfile, err := CreateHPFile(opts.BlockSize, layout.hpfDirName, header)
 	if err != nil {
-		return
+		return nil, err
 	}
-	res.mi.FromBytes(buf)
-	if !res.mi.closed {
-		err = errors.New("RabbitKV is not closed properly")
-		return
+	hpfile.Close()
+	ilog, err := CreateIndexLogger(layout.idxDirName, opts.RetainedLogFiles)
+	if err != nil {
+		return nil, err
 	}
+	ilog.Close()
 
-	res.hpfile, err = NewHPFile(int(res.mi.blockSize), hpfDirName)
+	mi := MetaInfo{
+		seed:          opts.Seed,
+		blockSize:     uint64(opts.BlockSize),
+		closed:        true,
+		formatVersion: FormatVersion,
+	}
+	if mi.seed == 0 {
+		var buf [8]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return nil, err
+		}
+		mi.seed = binary.LittleEndian.Uint64(buf[:])
+	}
+	mi.allAddrBits = initialAddrBits()
+	err = writeMetaFile(layout.metaFile, &mi, os.O_RDWR|os.O_CREATE|os.O_EXCL)
 	if err != nil {
-		return
+		return nil, err
 	}
-	res.ilog, err = NewIndexLogger(idxDirName)
+	return loadRabbitKV(layout, opts)
+}
+
+// Open an existing RabbitKV created under 'dir' by CreateRabbitKV. A nil 'opts' means DefaultOptions()
+func Open(dir string, opts *Options) (*RabbitKV, error) {
+	opts, err := opts.withDefaults()
 	if err != nil {
-		return
+		return nil, err
 	}
-	res.hb = NewHash3Bundle(res.mi.allAddrBits)
-	res.ilog.Scan(func(key uint64, value uint32) {
-		res.hb.Set(key, value)
-	})
+	return loadRabbitKV(newDirLayout(dir), opts)
+}
+
+// Deprecated: use Open instead, which uses a single root directory
+func LoadRabbitKV(hpfDirName, idxDirName, metaFile string) (*RabbitKV, error) {
+	layout := dirLayout{
+		hpfDirName: hpfDirName,
+		idxDirName: idxDirName,
+		metaFile:   metaFile,
+	}
+	return loadRabbitKV(layout, DefaultOptions())
+}
 
-	if !res.mi.closed { // not closed properly
-		res.RecoverMetaInfo()
+// The addrBits of every Hash3 in a new Hash3Bundle
+func initialAddrBits() (res [256]byte) {
+	for i := range res {
+		res[i] = MinAddrBits
 	}
-	res.mi.closed = false
 	return
 }
 
-func (rkv *RabbitKV) GabageCollect(lengthLimit, countLimit int64) {
-	start := int64(rkv.mi.nextGcPosition)
-	rkv.ScanSlots(start, start + lengthLimit, func(slot Slot, pos uint64, _ int) bool {
-		countLimit--
-		if countLimit < 0 {
-			return false // Stop Scan
+// Read the MetaInfo of the RabbitKV under 'dir', without opening it
+func ReadMetaInfo(dir string) (*MetaInfo, error) {
+	mi := &MetaInfo{}
+	if err := readMetaFile(newDirLayout(dir).metaFile, mi); err != nil {
+		return nil, err
+	}
+	return mi, nil
+}
+
+func (mi *MetaInfo) AllAddrBits() [256]byte  { return mi.allAddrBits }
+func (mi *MetaInfo) NextGcPosition() uint64  { return mi.nextGcPosition }
+func (mi *MetaInfo) ActiveByteCount() uint64 { return mi.activeByteCount }
+func (mi *MetaInfo) Seed() uint64            { return mi.seed }
+func (mi *MetaInfo) BlockSize() uint64       { return mi.blockSize }
+func (mi *MetaInfo) LastBatchSeq() uint64    { return mi.lastBatchSeq }
+func (mi *MetaInfo) Closed() bool            { return mi.closed }
+func (mi *MetaInfo) FormatVersion() uint32   { return mi.formatVersion }
+
+// Return ErrUnsupportedFormat unless the meta file is in the format of this library
+func checkFormatVersion(version uint32) error {
+	if version != FormatVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedFormat, version)
+	}
+	return nil
+}
+
+func readMetaFile(metaFile string, mi *MetaInfo) error {
+	f, err := os.Open(metaFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var buf [MetaInfoBytes]byte
+	_, err = io.ReadFull(f, buf[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: too short", ErrCorruptMeta)
+	} else if err != nil {
+		return err
+	}
+	return mi.FromBytes(buf)
+}
+
+func loadRabbitKV(layout dirLayout, opts *Options) (*RabbitKV, error) {
+	res := &RabbitKV{metaFile: layout.metaFile, opts: opts}
+	err := readMetaFile(layout.metaFile, &res.mi)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkFormatVersion(res.mi.formatVersion); err != nil {
+		return nil, err
+	}
+	if !opts.ChangeLog && !opts.ReadOnly {
+		// the batches committed without the change log would be missing in it
+		exists, err := changeLogExists(layout.clDirName)
+		if err != nil {
+			return nil, err
 		}
-		key64 := meow.Checksum64(rkv.mi.seed, slot.pairs[0].key)
-		if kv32 := rkv.hb.Find(key64); kv32 != nil {
-			rkv.mtx.Lock()
-			slices, _ := slot.ToSlicesForDump()
-			pos, err := rkv.hpfile.Append(slices)
-			if err != nil {
-				panic(err)
+		if exists {
+			return nil, ErrChangeLogRequired
+		}
+	}
+
+	res.hpfile, err = NewHPFile(int(res.mi.blockSize), layout.hpfDirName, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	res.ilog, err = NewIndexLogger(layout.idxDirName, opts.RetainedLogFiles, opts.ReadOnly)
+	if err != nil {
+		res.hpfile.Close()
+		return nil, err
+	}
+	err = res.load()
+	if err == nil && opts.ChangeLog {
+		err = res.openChangeLog(layout.clDirName)
+	}
+	if err != nil {
+		res.ilog.Close()
+		res.hpfile.Close()
+		return nil, err
+	}
+	res.bgStop = make(chan struct{})
+	res.gs.cond = sync.NewCond(&res.gs.mtx)
+	if !opts.ReadOnly && opts.GCInterval > 0 {
+		res.goBackground(res.backgroundGC)
+	}
+	if !opts.ReadOnly && opts.Sync.mode == syncInterval {
+		res.goBackground(res.backgroundSync)
+	}
+	return res, nil
+}
+
+func (rkv *RabbitKV) load() error {
+	// A read-only RabbitKV which is not closed properly may be still in use by another
+	// process, so we cannot recover it and just tolerate the incomplete tails
+	needRecovery := !rkv.mi.closed && !rkv.opts.ReadOnly
+	if needRecovery {
+		err := rkv.recoverHPFileTail()
+		if err != nil {
+			return err
+		}
+		size := rkv.hpfile.Size()
+		err = rkv.ilog.RecoverTail(func(value32 uint32) bool {
+			return rkv.slotPos(value32) >= size
+		})
+		if err != nil {
+			return err
+		}
+	}
+	rkv.hb = NewHash3Bundle(rkv.mi.allAddrBits)
+	if rkv.opts.KeepVersions > 0 {
+		// only the batches found in the retained files can be undone
+		rkv.history = newVersionHistory(rkv.mi.lastBatchSeq)
+	}
+	// A Hash3 shard is only complete after its dump at the beginning of a file is replayed, unless
+	// the first file is retained. The undo records taken before that point have wrong values
+	completeID := rkv.ilog.fileIDList[0] + 255
+	if rkv.ilog.fileIDList[0] == 0 {
+		completeID = 0
+	}
+	var replayedSeq, completeSeq uint64
+	complete := false
+	size := rkv.hpfile.Size()
+	err := rkv.ilog.Scan(!rkv.mi.closed, func(key uint64, value uint32, seq uint64) {
+		if value != 0 && rkv.slotPos(value) >= size {
+			// the slot was pruned, or lost in a crash and not recovered because of ReadOnly
+			return
+		}
+		if rkv.history != nil && seq != 0 {
+			if len(rkv.history.records) == 0 && seq-1 < rkv.history.oldest {
+				rkv.history.oldest = seq - 1
 			}
-			if pos%16 != 0 {
-				panic("Position is not X16")
+			var prev uint32
+			if kv32 := rkv.hb.Find(key); kv32 != nil {
+				prev = kv32.Value
 			}
-			kv32.Value = uint32(pos/16)
-			rkv.WriteLog(key64, kv32.Value)
-			rkv.mtx.Unlock()
+			rkv.history.add(seq, key, prev)
+		}
+		rkv.hb.Set(key, value)
+	}, func(seq uint64) {
+		replayedSeq = seq
+		if rkv.mi.lastBatchSeq < seq {
+			rkv.mi.lastBatchSeq = seq
+		}
+	}, func(id int64) {
+		if id == completeID {
+			complete, completeSeq = true, replayedSeq
 		}
-		return true
 	})
+	if err != nil {
+		return err
+	}
+	if !complete {
+		completeSeq = replayedSeq
+	}
+	if rkv.history != nil {
+		rkv.trimHistoryAfterLoad(completeSeq)
+	}
+
+	if needRecovery {
+		err = rkv.RecoverMetaInfo()
+		if err != nil {
+			return err
+		}
+	}
+	if rkv.opts.OrderedIndex {
+		err = rkv.buildOrderedIndex()
+		if err != nil {
+			return err
+		}
+	}
+	rkv.syncedGcPosition = rkv.mi.nextGcPosition
+	if !rkv.opts.ReadOnly {
+		rkv.mi.closed = false
+		return rkv.SaveMetaFile() // a crash can be detected since now
+	}
+	return nil
 }
 
-func (rkv *RabbitKV) RecoverMetaInfo() {
+func (rkv *RabbitKV) RecoverMetaInfo() error {
 	start, end := int64(rkv.mi.nextGcPosition), rkv.hpfile.Size()
 	rkv.mi.nextGcPosition = math.MaxUint64
 	rkv.mi.activeByteCount = 0
-	rkv.ScanSlots(start, end, func(slot Slot, pos uint64, length int) bool {
-		key64 := meow.Checksum64(rkv.mi.seed, slot.pairs[0].key)
-		if rkv.hb.Find(key64) != nil {
+	err := rkv.ScanSlots(start, end, func(slot Slot, pos uint64, length int) bool {
+		if slot.Empty() {
+			return true
+		}
+		if rkv.findSlotAt(rkv.slotKey64(&slot), int64(pos)) != nil {
 			if rkv.mi.nextGcPosition == math.MaxUint64 {
 				rkv.mi.nextGcPosition = pos
 			}
@@ -161,146 +521,422 @@ func (rkv *RabbitKV) RecoverMetaInfo() {
 		}
 		return true
 	})
+	if rkv.mi.nextGcPosition == math.MaxUint64 { // no active slot at all
+		rkv.mi.nextGcPosition = uint64(end)
+	}
+	return err
+}
+
+// Different keys may share the same KV32 entry in Hash3Bundle if their hashes collide. They
+// are stored as pairs in the same slot, so any pair in a slot can be used to find its KV32 entry
+func (rkv *RabbitKV) slotKey64(slot *Slot) uint64 {
+	return rkv.keyHash(slot.pairs[0].key)
 }
 
-func (rkv *RabbitKV) ScanSlots(start, end int64, fn func(slot Slot, pos uint64, length int) bool) {
+func (rkv *RabbitKV) keyHash(key []byte) uint64 {
+	return rkv.opts.keyHasher(rkv.mi.seed, key)
+}
+
+// Return the KV32 entry pointing to the slot at 'pos', or nil if this slot is no longer active
+func (rkv *RabbitKV) findSlotAt(key64 uint64, pos int64) *KV32 {
+	kv32 := rkv.hb.Find(key64)
+	if kv32 == nil || rkv.slotPos(kv32.Value) != pos {
+		return nil
+	}
+	return kv32
+}
+
+func (rkv *RabbitKV) ScanSlots(start, end int64, fn func(slot Slot, pos uint64, length int) bool) error {
 	for pos, length := start, 0; pos < end; pos += int64(length) {
-		slot, length := rkv.ReadSlot(pos)
+		var slot Slot
+		var err error
+		slot, length, err = rkv.ReadSlot(pos)
+		if err != nil {
+			return err
+		}
 		if !fn(slot, uint64(pos), length) {
 			break
 		}
 	}
+	return nil
 }
 
-func (rkv *RabbitKV) ReadSlot(pos int64) (Slot, int) {
+func (rkv *RabbitKV) ReadSlot(pos int64) (Slot, int, error) {
+	return rkv.tryReadSlot(pos, math.MaxInt32)
+}
+
+// Read a slot at 'pos' whose total length must be no larger than 'maxLength'
+func (rkv *RabbitKV) tryReadSlot(pos int64, maxLength int64) (Slot, int, error) {
 	var buf [4]byte
 	err := rkv.hpfile.ReadAt(buf[:], pos)
 	if err != nil {
-		panic(err)
+		return Slot{}, 0, err
 	}
 	length := int(binary.LittleEndian.Uint32(buf[:]))
+	if (length+4)%16 != 0 || int64(length+4) > maxLength {
+		return Slot{}, 0, fmt.Errorf("%w: invalid length %d at %d", ErrCorruptSlot, length, pos)
+	}
 	bz := make([]byte, length)
 	err = rkv.hpfile.ReadAt(bz, pos+4)
 	if err != nil {
-		panic(err)
+		return Slot{}, 0, err
 	}
 	slot, err := BytesToSlot(bz)
 	if err != nil {
-		panic(err)
+		return Slot{}, 0, fmt.Errorf("%w at %d", err, pos)
 	}
-	return slot, length+4
+	return slot, length + 4, nil
 }
 
-func (rkv *RabbitKV) Get(key []byte) []byte {
+// Append a slot to the HPFile and return its position and length
+func (rkv *RabbitKV) appendSlot(slot *Slot) (int64, int, error) {
+	size := rkv.hpfile.Size()
+	if size-rkv.hpfile.StartPos() >= PositionWindow {
+		return 0, 0, ErrPositionWindowFull
+	}
+	if size%PositionWindow == 0 {
+		// the KV32 value of this position would be zero, which means invalid, so an empty
+		// slot is put here like the one at the position 0
+		emptySlot := Slot{}
+		header, _ := emptySlot.ToSlicesForDump()
+		if _, err := rkv.hpfile.Append(header); err != nil {
+			return 0, 0, err
+		}
+	}
+	slices, length := slot.ToSlicesForDump()
+	pos, err := rkv.hpfile.Append(slices)
+	if err != nil {
+		return 0, 0, err
+	}
+	if pos%16 != 0 {
+		panic("Position is not X16")
+	}
+	return pos, length, nil
+}
+
+// The value of a KV32 entry pointing to the slot at 'pos'
+func value32Of(pos int64) uint32 {
+	return uint32(pos / 16)
+}
+
+// Return the position of the slot which a KV32 entry points to. 'mtx' must be read-locked or
+// 'wmtx' must be locked, such that the head of HPFile is not moved
+func (rkv *RabbitKV) slotPos(value32 uint32) int64 {
+	return positionAfter(rkv.hpfile.StartPos(), value32)
+}
+
+// Decode 'value32' to the position in [head, head+PositionWindow)
+func positionAfter(head int64, value32 uint32) int64 {
+	return head + (int64(value32)*16-head)&(PositionWindow-1)
+}
+
+// Return the value of 'key', or nil if it does not exist
+func (rkv *RabbitKV) Get(key []byte) ([]byte, error) {
 	rkv.mtx.RLock()
 	defer rkv.mtx.RUnlock()
-	key64 := meow.Checksum64(rkv.mi.seed, key)
-	kv32 := rkv.hb.Find(key64)
-	if !kv32.IsValid() {
-		return nil
+	if rkv.isClosed {
+		return nil, ErrClosed
+	}
+	return rkv.getFrom(&rkv.hb, key)
+}
+
+// Look up 'key' in 'hb', 'mtx' must be read-locked
+func (rkv *RabbitKV) getFrom(hb *Hash3Bundle, key []byte) ([]byte, error) {
+	value32 := hb.lookup(rkv.keyHash(key))
+	if value32 == 0 {
+		return nil, nil
+	}
+	slot, _, err := rkv.ReadSlot(rkv.slotPos(value32))
+	if err != nil {
+		return nil, err
 	}
-	pos := int64(kv32.Value)*16
-	slot, _ := rkv.ReadSlot(pos)
 	value := slot.Get(key)
 	if value == nil {
-		return nil
+		return nil, nil
 	} else {
-		return append([]byte{}, value...)
+		return append([]byte{}, value...), nil
 	}
 }
 
-func (rkv *RabbitKV) Set(key, value []byte) {
+func (rkv *RabbitKV) Set(key, value []byte) error {
 	if value == nil {
-		panic("Cannot set a nil value")
+		return ErrNilValue
+	}
+	return rkv.update(key, value)
+}
+
+func (rkv *RabbitKV) Delete(key []byte) error {
+	return rkv.update(key, nil)
+}
+
+func (rkv *RabbitKV) update(key, value []byte) error {
+	ticket, err := rkv.writeUpdate(key, value)
+	if err == nil && rkv.opts.Sync.mode == syncEveryWrite {
+		err = rkv.waitSynced(ticket)
+	}
+	return err
+}
+
+// Write the update and return its ticket for waitSynced
+func (rkv *RabbitKV) writeUpdate(key, value []byte) (uint64, error) {
+	rkv.wmtx.Lock()
+	defer rkv.wmtx.Unlock()
+	if err := rkv.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := rkv.checkRoom(); err != nil {
+		return 0, err
+	}
+	var err error
+	if rkv.history != nil || rkv.changes != nil {
+		err = rkv.commitBatch(map[string][]byte{string(key): value})
+		if err != nil {
+			err = rkv.fail(err)
+		}
+	} else {
+		err = rkv.updateLocked(key, value)
+	}
+	if err == nil {
+		err = rkv.maybeAddNewLogFile()
+	}
+	return rkv.nextTicket(), err
+}
+
+// Return the ticket of a write, 'wmtx' must be locked
+func (rkv *RabbitKV) nextTicket() uint64 {
+	rkv.writeTicket++
+	return rkv.writeTicket
+}
+
+// Record an error which happened after some files were modified, 'wmtx' must be locked
+func (rkv *RabbitKV) fail(err error) error {
+	rkv.writeErr = err
+	return err
+}
+
+// Return an error if writing is not allowed now, 'wmtx' must be locked
+func (rkv *RabbitKV) checkWritable() error {
+	if rkv.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if rkv.isClosed {
+		return ErrClosed
+	}
+	return rkv.writeErr
+}
+
+// Return ErrPositionWindowFull if the HPFile has no room for the writes other than garbage
+// collection. It is checked before anything is written, so the RabbitKV does not fail, and the
+// writes are allowed again when garbage collection has pruned enough blocks. 'wmtx' must be locked
+func (rkv *RabbitKV) checkRoom() error {
+	size := rkv.hpfile.Size()
+	if size-rkv.hpfile.StartPos() >= PositionWindow-positionReserve {
+		return ErrPositionWindowFull
 	}
-	rkv.update(key, value)
+	return nil
 }
 
-func (rkv *RabbitKV) Delete(key []byte) {
-	rkv.update(key, nil)
+// An update whose slot has been appended and whose index-log entry has been written, but which
+// is not visible to the readers until it is published
+type pendingUpdate struct {
+	key     []byte
+	value   []byte
+	key64   uint64
+	prev    uint32 // the value of the KV32 entry before the update, or zero if not found
+	value32 uint32 // the value of the KV32 entry after the update, or zero if the slot is removed
+	oldLen  int
+	newLen  int
 }
 
-func (rkv *RabbitKV) update(key, value []byte) {
+// Write and publish an update out of batches, 'wmtx' must be locked
+func (rkv *RabbitKV) updateLocked(key, value []byte) error {
+	p, err := rkv.prepareUpdate(key, value, nil)
+	if err != nil || p == nil {
+		return err
+	}
+	if !rkv.opts.OrderedIndex {
+		rkv.publishInShard(p)
+		return nil
+	}
+	rkv.makeRoom([]*pendingUpdate{p})
 	rkv.mtx.Lock()
-	defer rkv.mtx.Unlock()
-	key64 := meow.Checksum64(rkv.mi.seed, key)
-	kv32, status := rkv.hb.FindX(key64)
-	if status == Found {
-		pos := int64(kv32.Value)*16
-		slot, length := rkv.ReadSlot(pos)
-		rkv.mi.activeByteCount -= uint64(length)
+	rkv.publish(p, 0)
+	rkv.mtx.Unlock()
+	return nil
+}
+
+// Append the new slot of 'key' and write its index-log entry, 'wmtx' must be locked. The updates
+// written but not published yet are recorded in 'pending', such that the keys sharing a KV32 entry
+// in the same batch can find the new slot. A nil result means nothing to do
+func (rkv *RabbitKV) prepareUpdate(key, value []byte, pending map[uint64]uint32) (*pendingUpdate, error) {
+	key64 := rkv.keyHash(key)
+	p := &pendingUpdate{key: key, value: value, key64: key64}
+	var ok bool
+	if p.prev, ok = pending[key64]; !ok {
+		if kv32 := rkv.hb.Find(key64); kv32 != nil {
+			p.prev = kv32.Value
+		}
+	}
+	var slot Slot
+	if p.prev != 0 {
+		var err error
+		slot, p.oldLen, err = rkv.ReadSlot(rkv.slotPos(p.prev))
+		if err != nil {
+			return nil, err
+		}
 		if value == nil { //deletion
-			slot.Remove(key)
+			if !slot.Remove(key) {
+				return nil, nil // another key with the same hash is found, nothing to delete
+			}
 		} else {
 			slot.Add(Pair{key, value})
 		}
-		if slot.Empty() {
-			kv32.Value = 0 // invalidate it
-		} else {
-			slices, newLen := slot.ToSlicesForDump()
-			rkv.mi.activeByteCount += uint64(newLen)
-			pos, err := rkv.hpfile.Append(slices)
-			if err != nil {
-				panic(err)
-			}
-			if pos%16 != 0 {
-				panic("Position is not X16")
-			}
-			kv32.Value = uint32(pos/16)
+	} else if value == nil { //nothing to do for deletion when not found
+		return nil, nil
+	} else {
+		slot = NewSlot(key, value)
+	}
+	if !slot.Empty() { // otherwise the KV32 entry is invalidated
+		pos, newLen, err := rkv.appendSlot(&slot)
+		if err != nil {
+			return nil, rkv.fail(err)
 		}
-		rkv.WriteLog(key64, kv32.Value)
-		return
+		p.value32, p.newLen = value32Of(pos), newLen
+	}
+	if err := rkv.writeLogOrFail(key64, p.value32); err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		pending[key64] = p.value32
 	}
+	return p, nil
+}
 
-	if value == nil { //nothing to do for deletion when NotFound
-		return
+// Make the update visible to the readers, 'wmtx' and 'mtx' must be locked. A non-zero 'seq' is
+// the sequence number of the batch being committed
+func (rkv *RabbitKV) publish(p *pendingUpdate, seq uint64) {
+	if rkv.history != nil && seq != 0 {
+		rkv.history.add(seq, p.key64, p.prev)
 	}
+	rkv.setEntry(p)
+	rkv.updateOrderedIndex(p.key, p.value)
+}
 
-	if status == NotFoundAndFull {
-		rkv.hb.EnlargeForKey(key64)
-		kv32, status = rkv.hb.FindX(key64)
+// Publish the update by changing its shard only, such that the readers of the other shards are
+// not blocked. 'wmtx' must be locked
+func (rkv *RabbitKV) publishInShard(p *pendingUpdate) {
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	lock := rkv.hb.shardLock(p.key64)
+	lock.Lock()
+	defer lock.Unlock()
+	rkv.setEntry(p)
+}
+
+// Enlarge the shards in advance for the keys to be inserted, such that the enlargement blocks
+// only the readers of the same shards, instead of all the readers blocked by publish. 'wmtx'
+// must be locked
+func (rkv *RabbitKV) makeRoom(updates []*pendingUpdate) {
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	for _, p := range updates {
+		if p.prev != 0 || p.value32 == 0 {
+			continue // not an insertion
+		}
+		lock := rkv.hb.shardLock(p.key64)
+		lock.Lock()
+		rkv.hb.ensureRoom(p.key64)
+		lock.Unlock()
 	}
+}
 
-	if status == Found || status == NotFoundAndFull {
+// Change the KV32 entry of the update, 'wmtx' must be locked, and 'mtx' must be locked or
+// read-locked with the lock of the shard locked
+func (rkv *RabbitKV) setEntry(p *pendingUpdate) {
+	kv32, status := rkv.hb.FindX(p.key64)
+	if status == NotFoundAndFull {
+		rkv.hb.EnlargeForKey(p.key64)
+		kv32, status = rkv.hb.FindX(p.key64)
+	}
+	if status == NotFoundAndFull {
 		panic("Impossible case, bug here")
 	}
+	kv32.Key = uint32(p.key64)
+	kv32.Value = p.value32
+	atomic.AddUint64(&rkv.mi.activeByteCount, uint64(p.newLen)-uint64(p.oldLen))
+}
 
-	// now status == NotFoundAndCanInsert
-	slot := NewSlot(key, value)
-	slices, newLen := slot.ToSlicesForDump()
-	pos, err := rkv.hpfile.Append(slices)
-	rkv.mi.activeByteCount += uint64(newLen)
+func (rkv *RabbitKV) WriteLog(key64 uint64, value32 uint32) error {
+	_, err := rkv.ilog.Write(key64, value32)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if pos%16 != 0 {
-		panic("Position is not X16")
+	rkv.wrLogCount++
+	return nil
+}
+
+func (rkv *RabbitKV) writeLogOrFail(key64 uint64, value32 uint32) error {
+	if err := rkv.WriteLog(key64, value32); err != nil {
+		return rkv.fail(err)
 	}
-	kv32.Value = uint32(pos/16)
-	rkv.WriteLog(key64, kv32.Value)
+	return nil
 }
 
-func (rkv *RabbitKV) WriteLog(key64 uint64, value32 uint32) {
-	rkv.ilog.Write(key64, value32)
-	rkv.wrLogCount++
-	if rkv.wrLogCount%1024 == 0 {
-		estBytesInHash3 := rkv.hb.EstimatedCount()*EntryLengthInLog/256
-		if rkv.ilog.SizeOfLastFile() > 4*estBytesInHash3 {
-			rkv.ilog.AddNewFile(&rkv.hb)
-			rkv.SaveMetaFile() //just record allAddrBits
+// Start a new index-log file if the last one is large enough. It must not be called inside
+// a batch, which should not span two files. 'wmtx' must be locked
+func (rkv *RabbitKV) maybeAddNewLogFile() error {
+	if rkv.wrLogCount < 1024 {
+		return nil
+	}
+	rkv.wrLogCount = 0
+	estBytesInHash3 := rkv.hb.EstimatedCount() * EntryLengthInLog / 256
+	size, err := rkv.ilog.SizeOfLastFile()
+	if err != nil {
+		return err
+	}
+	if size > rkv.opts.IndexRotateRatio*estBytesInHash3 {
+		// only the latest file is recovered, so the older ones must not point at the slots
+		// which may be lost in a crash
+		if err = rkv.hpfile.Sync(); err != nil {
+			return rkv.fail(err)
 		}
+		err = rkv.ilog.AddNewFile(&rkv.hb)
+		if err != nil {
+			return rkv.fail(err)
+		}
+		return rkv.SaveMetaFile() //just record allAddrBits
 	}
+	return nil
 }
 
-func (rkv *RabbitKV) Sync() {
-	err := rkv.ilog.Sync()
-	if err != nil {
-		panic(err)
+// Flush the HPFile and the index log to the disk
+func (rkv *RabbitKV) Sync() error {
+	rkv.wmtx.Lock()
+	defer rkv.wmtx.Unlock()
+	if rkv.isClosed {
+		return ErrClosed
 	}
-	err = rkv.hpfile.Sync()
+	return rkv.sync()
+}
+
+// 'wmtx' must be locked
+func (rkv *RabbitKV) sync() error {
+	// the slots and the change records are flushed before the index-log entries committing
+	// them, such that a batch is never committed on the disk with some of them lost
+	err := rkv.hpfile.Sync()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if rkv.changes != nil {
+		if err = rkv.changes.sync(); err != nil {
+			return err
+		}
 	}
+	if err = rkv.ilog.Sync(); err != nil {
+		return err
+	}
+	rkv.syncedGcPosition = rkv.mi.nextGcPosition
+	return nil
 }
 
 // ============================================
@@ -317,30 +953,101 @@ func (rkv *RabbitKV) NewBatch() *Batch {
 	}
 }
 
-func (batch *Batch) Close() {
-	for k, v := range batch.cache {
-		batch.rkv.update([]byte(k), v)
-	}
-	batch.rkv.Sync()
+// Commit all the cached updates atomically: after a crash, either all or none of them
+// are found when the RabbitKV is opened again
+func (batch *Batch) Close() error {
+	cache := batch.cache
 	batch.cache = nil
+	if len(cache) == 0 {
+		return nil
+	}
+	rkv := batch.rkv
+	ticket, err := rkv.writeBatch(cache)
+	if err == nil && (rkv.opts.Sync.mode == syncOnBatch || rkv.opts.Sync.mode == syncEveryWrite) {
+		err = rkv.waitSynced(ticket)
+	}
+	return err
+}
+
+// Commit the batch and return its ticket for waitSynced
+func (rkv *RabbitKV) writeBatch(cache map[string][]byte) (uint64, error) {
+	rkv.wmtx.Lock()
+	defer rkv.wmtx.Unlock()
+	if err := rkv.checkWritable(); err != nil {
+		return 0, err
+	}
+	if err := rkv.checkRoom(); err != nil {
+		return 0, err
+	}
+	if err := rkv.commitBatch(cache); err != nil {
+		return 0, rkv.fail(err)
+	}
+	err := rkv.maybeAddNewLogFile()
+	return rkv.nextTicket(), err
 }
 
-func (batch *Batch) Get(key []byte) []byte {
+// The updates are written between a pair of begin and commit entries in the index log, and then
+// published together, 'wmtx' must be locked
+func (rkv *RabbitKV) commitBatch(cache map[string][]byte) error {
+	seq := rkv.mi.lastBatchSeq + 1
+	_, err := rkv.ilog.WriteControl(batchBeginEntry, seq)
+	if err != nil {
+		return err
+	}
+	if rkv.changes != nil {
+		// recorded before being committed, and removed by recovery if not committed
+		if err = rkv.changes.append(seq, cache); err != nil {
+			return err
+		}
+	}
+	pending := make(map[uint64]uint32, len(cache))
+	updates := make([]*pendingUpdate, 0, len(cache))
+	for k, v := range cache {
+		p, err := rkv.prepareUpdate([]byte(k), v, pending)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			updates = append(updates, p)
+		}
+	}
+	_, err = rkv.ilog.WriteControl(batchCommitEntry, seq)
+	if err != nil {
+		return err
+	}
+	rkv.makeRoom(updates)
+	rkv.mtx.Lock()
+	defer rkv.mtx.Unlock()
+	for _, p := range updates {
+		rkv.publish(p, seq)
+	}
+	rkv.mi.lastBatchSeq = seq
+	if rkv.history != nil {
+		rkv.history.trim(rkv.retainedVersion())
+	}
+	if rkv.changes != nil {
+		close(rkv.changeNotify)
+		rkv.changeNotify = make(chan struct{})
+	}
+	return nil
+}
+
+func (batch *Batch) Get(key []byte) ([]byte, error) {
 	v, ok := batch.cache[string(key)]
 	if ok {
-		return v
+		return v, nil
 	}
 	return batch.rkv.Get(key)
 }
 
-func (batch *Batch) Set(key, value []byte) {
+func (batch *Batch) Set(key, value []byte) error {
 	if value == nil {
-		panic("Cannot set a nil value")
+		return ErrNilValue
 	}
 	batch.cache[string(key)] = value
+	return nil
 }
 
 func (batch *Batch) Delete(key []byte) {
 	batch.cache[string(key)] = nil
 }
-
@@ -0,0 +1,738 @@
+package rabbitkv
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/meow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rabbitkv")
+	require.NoError(t, err)
+	return dir
+}
+
+func getString(t *testing.T, rkv *RabbitKV, key string) string {
+	v, err := rkv.Get([]byte(key))
+	require.NoError(t, err)
+	return string(v)
+}
+
+func TestCreateAndReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, rkv.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	for i := 0; i < 1000; i += 3 {
+		require.NoError(t, rkv.Delete([]byte(fmt.Sprintf("key%d", i))))
+	}
+	require.NoError(t, rkv.Set([]byte("key1"), []byte("new value")))
+	assert.Equal(t, "new value", getString(t, rkv, "key1"))
+	rkv.Close()
+
+	_, err = CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	assert.Error(t, err)
+
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	defer rkv.Close()
+	assert.Equal(t, "new value", getString(t, rkv, "key1"))
+	for i := 2; i < 1000; i++ {
+		v, err := rkv.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		if i%3 == 0 {
+			assert.Nil(t, v)
+		} else {
+			assert.Equal(t, fmt.Sprintf("value%d", i), string(v))
+		}
+	}
+}
+
+func TestMetaFileReplaced(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("key"), []byte("value")))
+	crash(rkv)
+	mi, err := ReadMetaInfo(dir)
+	require.NoError(t, err)
+	assert.False(t, mi.Closed())
+
+	// a meta file being written aside when crashed is ignored and replaced
+	tmpFile := filepath.Join(dir, MetaFileName+".tmp")
+	require.NoError(t, ioutil.WriteFile(tmpFile, []byte{1, 2, 3}, 0600))
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "value", getString(t, rkv, "key"))
+	require.NoError(t, rkv.Close())
+	_, err = os.Stat(tmpFile)
+	assert.True(t, os.IsNotExist(err))
+	mi, err = ReadMetaInfo(dir)
+	require.NoError(t, err)
+	assert.True(t, mi.Closed())
+
+	// an existing meta file is not replaced when created
+	err = writeMetaFile(filepath.Join(dir, MetaFileName), &rkv.mi, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+	assert.True(t, os.IsExist(err))
+	_, err = os.Stat(tmpFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := CreateRabbitKV(dir, &Options{BlockSize: 1000})
+	assert.Error(t, err)
+	_, err = CreateRabbitKV(dir, &Options{RetainedLogFiles: 256})
+	assert.Error(t, err)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096, Seed: 12345, Sync: SyncNone})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(12345), rkv.mi.seed)
+	batch := rkv.NewBatch()
+	require.NoError(t, batch.Set([]byte("key"), []byte("value")))
+	require.NoError(t, batch.Close())
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4096), rkv.mi.blockSize)
+	assert.Equal(t, "value", getString(t, rkv, "key"))
+	assert.Equal(t, ErrReadOnly, rkv.Set([]byte("key"), []byte("other")))
+	rkv.Close()
+
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "value", getString(t, rkv, "key"))
+	rkv.Close()
+}
+
+// Close the files without saving the meta file, like a killed process
+func crash(rkv *RabbitKV) {
+	rkv.stopBackground()
+	rkv.ilog.Close()
+	rkv.hpfile.Close()
+}
+
+func appendToFile(t *testing.T, fname string, bz []byte) {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write(bz)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestCrashRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		require.NoError(t, rkv.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	for i := 0; i < 300; i += 2 {
+		require.NoError(t, rkv.Delete([]byte(fmt.Sprintf("key%d", i))))
+	}
+	activeByteCount := rkv.mi.activeByteCount
+	hpfSize := rkv.hpfile.Size()
+	hpfTail := fmt.Sprintf("%s/%d-%d", newDirLayout(dir).hpfDirName, rkv.hpfile.largestID, 4096)
+	ilogTail := fmt.Sprintf("%s/%d", newDirLayout(dir).idxDirName, rkv.ilog.fileIDList[len(rkv.ilog.fileIDList)-1])
+	crash(rkv)
+
+	// torn tails: a partial slot and a partial index-log entry
+	slot := NewSlot([]byte("torn"), []byte("tail"))
+	slices, _ := slot.ToSlicesForDump()
+	appendToFile(t, hpfTail, append(append([]byte{}, slices[0]...), slices[1][:2]...))
+	appendToFile(t, ilogTail, []byte{1, 2, 3, 4})
+
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, hpfSize, rkv.hpfile.Size())
+	assert.Equal(t, activeByteCount, rkv.mi.activeByteCount)
+	for i := 0; i < 300; i++ {
+		v, err := rkv.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		if i%2 == 0 {
+			assert.Nil(t, v)
+		} else {
+			assert.Equal(t, fmt.Sprintf("value%d", i), string(v))
+		}
+	}
+	require.NoError(t, rkv.Set([]byte("key0"), []byte("again")))
+	crash(rkv)
+
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "again", getString(t, rkv, "key0"))
+	assert.Equal(t, "value1", getString(t, rkv, "key1"))
+	rkv.Close()
+}
+
+// Cut off the HPFile after 'size', which must be in block 0 of 4096 bytes
+func cutHPFile(t *testing.T, dir string, size int64) {
+	require.NoError(t, os.Truncate(fmt.Sprintf("%s/0-4096", newDirLayout(dir).hpfDirName), size))
+}
+
+func TestLostSlotRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("k1"), []byte("v1")))
+	require.NoError(t, rkv.Sync())
+	size := rkv.hpfile.Size()
+	require.NoError(t, rkv.Set([]byte("k1"), []byte("v2")))
+	require.NoError(t, rkv.Sync())
+	crash(rkv)
+
+	// the entry of the lost slot is removed, so it does not point at the slot appended later
+	cutHPFile(t, dir, size)
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", getString(t, rkv, "k1"))
+	require.NoError(t, rkv.Set([]byte("k2"), []byte("v2")))
+	require.NoError(t, rkv.Close())
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", getString(t, rkv, "k1"))
+	assert.Equal(t, "v2", getString(t, rkv, "k2"))
+	require.NoError(t, rkv.Close())
+}
+
+func TestLostSlotOfBatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	batch := rkv.NewBatch()
+	require.NoError(t, batch.Set([]byte("a"), []byte("1")))
+	require.NoError(t, batch.Set([]byte("b"), []byte("2")))
+	require.NoError(t, batch.Close())
+	require.NoError(t, rkv.Sync())
+	size := rkv.hpfile.Size()
+	crash(rkv)
+
+	// a committed batch with one of its slots cut off is undone as a whole
+	cutHPFile(t, dir, size-32)
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), rkv.mi.lastBatchSeq)
+	assert.Equal(t, "", getString(t, rkv, "a"))
+	assert.Equal(t, "", getString(t, rkv, "b"))
+	require.NoError(t, rkv.Set([]byte("c"), []byte("3")))
+	require.NoError(t, rkv.Close())
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "", getString(t, rkv, "a"))
+	assert.Equal(t, "", getString(t, rkv, "b"))
+	assert.Equal(t, "3", getString(t, rkv, "c"))
+	require.NoError(t, rkv.Close())
+}
+
+func TestUnflushedGcPosition(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096, GCInterval: -1})
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("k1"), []byte("v1")))
+	require.NoError(t, rkv.Set([]byte("k2"), []byte("v2")))
+	require.NoError(t, rkv.Sync())
+	size := rkv.hpfile.Size()
+	activeByteCount := rkv.mi.activeByteCount
+	pos := rkv.slotPos(rkv.hb.lookup(rkv.keyHash([]byte("k1"))))
+	require.NoError(t, rkv.GabageCollect(4096, 2))
+	assert.True(t, rkv.mi.nextGcPosition > uint64(pos))
+	// like the rotation of the index log, before the relocated slot is flushed
+	rkv.wmtx.Lock()
+	require.NoError(t, rkv.SaveMetaFile())
+	rkv.wmtx.Unlock()
+	crash(rkv)
+
+	// the slot of k1 before the saved nextGcPosition is still counted and collected
+	cutHPFile(t, dir, size)
+	rkv, err = Open(dir, &Options{GCInterval: -1})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(pos), rkv.mi.nextGcPosition)
+	assert.Equal(t, activeByteCount, rkv.mi.activeByteCount)
+	require.NoError(t, rkv.GabageCollect(1<<20, 1<<20))
+	assert.Equal(t, "v1", getString(t, rkv, "k1"))
+	assert.Equal(t, "v2", getString(t, rkv, "k2"))
+	require.NoError(t, rkv.Close())
+	assert.True(t, verify(t, dir).OK())
+}
+
+func TestErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	assert.Equal(t, ErrNilValue, rkv.Set([]byte("key"), nil))
+	require.NoError(t, rkv.Set([]byte("key"), []byte("value")))
+
+	// corrupt the payload of the slot
+	kv32 := rkv.hb.Find(meow.Checksum64(rkv.mi.seed, []byte("key")))
+	require.NotNil(t, kv32)
+	f := rkv.hpfile.fileMap[0]
+	_, err = f.WriteAt([]byte("X"), int64(kv32.Value)*16+20)
+	require.NoError(t, err)
+	_, err = rkv.Get([]byte("key"))
+	assert.True(t, errors.Is(err, ErrCorruptSlot))
+	assert.True(t, errors.Is(rkv.Delete([]byte("key")), ErrCorruptSlot))
+
+	require.NoError(t, rkv.Close())
+	assert.Equal(t, ErrClosed, rkv.Close())
+	_, err = rkv.Get([]byte("key"))
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, rkv.Set([]byte("key"), []byte("value")))
+
+	appendToFile(t, newDirLayout(dir).idxDirName+"/0", []byte{1, 2, 3})
+	_, err = Open(dir, nil)
+	assert.True(t, errors.Is(err, ErrCorruptIndexLog))
+
+	f, err = os.OpenFile(newDirLayout(dir).metaFile, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xFF}, 10)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = Open(dir, nil)
+	assert.True(t, errors.Is(err, ErrCorruptMeta))
+}
+
+func TestAtomicBatch(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	batch := rkv.NewBatch()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%d", i)), []byte("old")))
+	}
+	require.NoError(t, batch.Close())
+	assert.Equal(t, uint64(1), rkv.mi.lastBatchSeq)
+
+	// a batch torn by a crash: some of its updates are written without the commit entry
+	_, err = rkv.ilog.WriteControl(batchBeginEntry, rkv.mi.lastBatchSeq+1)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, rkv.updateLocked([]byte(fmt.Sprintf("key%d", i)), []byte("new")))
+	}
+	require.NoError(t, rkv.updateLocked([]byte("key100"), []byte("new")))
+	crash(rkv)
+
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), rkv.mi.lastBatchSeq)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "old", getString(t, rkv, fmt.Sprintf("key%d", i)))
+	}
+	assert.Equal(t, "", getString(t, rkv, "key100"))
+
+	batch = rkv.NewBatch()
+	require.NoError(t, batch.Set([]byte("key0"), []byte("new")))
+	batch.Delete([]byte("key1"))
+	require.NoError(t, batch.Close())
+	crash(rkv)
+
+	rkv, err = Open(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), rkv.mi.lastBatchSeq)
+	assert.Equal(t, "new", getString(t, rkv, "key0"))
+	assert.Equal(t, "", getString(t, rkv, "key1"))
+	assert.Equal(t, "old", getString(t, rkv, "key2"))
+	require.NoError(t, rkv.Close())
+}
+
+// Only 3 bits of the hash are kept, so most keys share their KV32 entries and slots with others
+func collidingHasher(seed uint64, key []byte) uint64 {
+	return meow.Checksum64(seed, key) & 0x7
+}
+
+func checkCollidingKeys(t *testing.T, rkv *RabbitKV, n int) {
+	for i := 0; i < n; i++ {
+		v := getString(t, rkv, fmt.Sprintf("key%d", i))
+		if i%3 == 0 {
+			assert.Equal(t, "", v)
+		} else if i%5 == 0 {
+			assert.Equal(t, fmt.Sprintf("updated%d", i), v)
+		} else {
+			assert.Equal(t, fmt.Sprintf("value%d", i), v)
+		}
+	}
+}
+
+func TestHashCollisions(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	const n = 200
+	opts := &Options{BlockSize: 4096, keyHasher: collidingHasher}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		require.NoError(t, rkv.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	for i := 0; i < n; i++ {
+		if i%3 == 0 { // including the first pairs of all the slots
+			require.NoError(t, rkv.Delete([]byte(fmt.Sprintf("key%d", i))))
+		} else if i%5 == 0 {
+			require.NoError(t, rkv.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("updated%d", i))))
+		}
+	}
+	require.NoError(t, rkv.Delete([]byte("no-such-key")))
+	checkCollidingKeys(t, rkv, n)
+
+	// relocate all the active slots
+	size := rkv.hpfile.Size()
+	require.NoError(t, rkv.GabageCollect(size, size))
+	checkCollidingKeys(t, rkv, n)
+	activeByteCount := rkv.mi.activeByteCount
+	crash(rkv)
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	assert.Equal(t, activeByteCount, rkv.mi.activeByteCount)
+	checkCollidingKeys(t, rkv, n)
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	checkCollidingKeys(t, rkv, n)
+	require.NoError(t, rkv.Close())
+}
+
+func TestForEach(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// 40 hashes sharing the same L1, L2 and L3 buckets, with collisions
+	opts := &Options{BlockSize: 4096, keyHasher: func(seed uint64, key []byte) uint64 {
+		var i int
+		fmt.Sscanf(string(key), "key%d", &i)
+		return uint64(i%40) << 4
+	}}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	const n = 500
+	for i := 0; i < n; i++ {
+		require.NoError(t, rkv.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	assert.Equal(t, 40, rkv.hb.shardLen(0))
+	for i := 0; i < n; i += 7 {
+		require.NoError(t, rkv.Delete([]byte(fmt.Sprintf("key%d", i))))
+	}
+	visited := make(map[string]string)
+	err = rkv.ForEach(func(key, value []byte) bool {
+		_, ok := visited[string(key)]
+		assert.False(t, ok)
+		visited[string(key)] = string(value)
+		return true
+	})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		v, ok := visited[fmt.Sprintf("key%d", i)]
+		if i%7 == 0 {
+			assert.False(t, ok)
+		} else {
+			assert.Equal(t, fmt.Sprintf("value%d", i), v)
+		}
+	}
+	assert.Equal(t, n-(n+6)/7, len(visited))
+
+	count := 0
+	err = rkv.ForEach(func(key, value []byte) bool {
+		count++
+		return count < 10
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 10, count)
+	require.NoError(t, rkv.Close())
+}
+
+func TestReadDuringWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("a"), []byte("1")))
+
+	// a writer holding wmtx does not block the readers
+	rkv.wmtx.Lock()
+	done := make(chan error)
+	go func() {
+		done <- rkv.Set([]byte("a"), []byte("2"))
+	}()
+	assert.Equal(t, "1", getString(t, rkv, "a"))
+	rkv.wmtx.Unlock()
+	require.NoError(t, <-done)
+	assert.Equal(t, "2", getString(t, rkv, "a"))
+
+	// the keys sharing a KV32 entry in one batch
+	require.NoError(t, rkv.Close())
+	opts := &Options{BlockSize: 4096, keyHasher: collidingHasher}
+	dir2 := tempDir(t)
+	defer os.RemoveAll(dir2)
+	rkv, err = CreateRabbitKV(dir2, opts)
+	require.NoError(t, err)
+	batch := rkv.NewBatch()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(t, batch.Close())
+	batch = rkv.NewBatch()
+	for i := 0; i < 50; i += 3 {
+		batch.Delete([]byte(fmt.Sprintf("key%d", i)))
+	}
+	for i := 5; i < 50; i += 5 {
+		if i%3 == 0 {
+			continue
+		}
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("updated%d", i))))
+	}
+	require.NoError(t, batch.Close())
+	checkCollidingKeys(t, rkv, 50)
+	activeByteCount := rkv.mi.activeByteCount
+	crash(rkv)
+	rkv, err = Open(dir2, opts)
+	require.NoError(t, err)
+	assert.Equal(t, activeByteCount, rkv.mi.activeByteCount)
+	checkCollidingKeys(t, rkv, 50)
+	require.NoError(t, rkv.Close())
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: time.Millisecond, GCStepBytes: 4096, KeepVersions: 10}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	const writers, rounds, keys = 4, 50, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 1; r <= rounds; r++ {
+				batch := rkv.NewBatch()
+				for k := 0; k < keys; k++ {
+					assert.NoError(t, batch.Set([]byte(fmt.Sprintf("w%d-%d", w, k)), []byte(fmt.Sprint(r))))
+				}
+				assert.NoError(t, batch.Close())
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		readers.Add(1)
+		go func(w int) {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// all the keys of a batch are published together
+				snap, err := rkv.NewSnapshot()
+				require.NoError(t, err)
+				first, err := snap.Get([]byte(fmt.Sprintf("w%d-0", w)))
+				assert.NoError(t, err)
+				for k := 1; k < keys; k++ {
+					v, err := snap.Get([]byte(fmt.Sprintf("w%d-%d", w, k)))
+					assert.NoError(t, err)
+					assert.Equal(t, string(first), string(v))
+				}
+				snap.Release()
+				_, err = rkv.Get([]byte(fmt.Sprintf("w%d-0", w)))
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	for w := 0; w < writers; w++ {
+		for k := 0; k < keys; k++ {
+			assert.Equal(t, fmt.Sprint(rounds), getString(t, rkv, fmt.Sprintf("w%d-%d", w, k)))
+		}
+	}
+	require.NoError(t, rkv.Close())
+}
+
+func TestShardLocks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096})
+	require.NoError(t, err)
+	var keys []string // the first key and some keys in the other shards
+	for i := 0; len(keys) < 3; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if len(keys) == 0 || rkv.keyHash([]byte(key))>>56 != rkv.keyHash([]byte(keys[0]))>>56 {
+			keys = append(keys, key)
+			require.NoError(t, rkv.Set([]byte(key), []byte("1")))
+		}
+	}
+
+	// a locked shard blocks neither the readers nor the writers of the other shards
+	lock := rkv.hb.shardLock(rkv.keyHash([]byte(keys[0])))
+	lock.Lock()
+	done := make(chan string)
+	go func() {
+		done <- getString(t, rkv, keys[0])
+	}()
+	assert.Equal(t, "1", getString(t, rkv, keys[1]))
+	require.NoError(t, rkv.Set([]byte(keys[2]), []byte("2")))
+	assert.Equal(t, "2", getString(t, rkv, keys[2]))
+	select {
+	case <-done:
+		t.Fatal("the reader of the locked shard is not blocked")
+	default:
+	}
+	lock.Unlock()
+	assert.Equal(t, "1", <-done)
+	require.NoError(t, rkv.Close())
+}
+
+func TestPositionWindow(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	require.NoError(t, rkv.Close())
+
+	// pretend that the blocks before the last one in the first window have been pruned
+	layout := newDirLayout(dir)
+	headID := PositionWindow/4096 - 1
+	require.NoError(t, os.Rename(filepath.Join(layout.hpfDirName, "0-4096"),
+		filepath.Join(layout.hpfDirName, fmt.Sprintf("%d-4096", headID))))
+	var mi MetaInfo
+	require.NoError(t, readMetaFile(layout.metaFile, &mi))
+	mi.nextGcPosition = uint64(headID * 4096)
+	require.NoError(t, writeMetaFile(layout.metaFile, &mi, os.O_RDWR))
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	// fill the block, such that the next slot would begin at PositionWindow, whose KV32 value is zero
+	var value []byte
+	for {
+		slot := NewSlot([]byte("first"), value)
+		if _, n := slot.ToSlicesForDump(); n == 4096-16 {
+			break
+		}
+		value = append(value, 'v')
+	}
+	require.NoError(t, rkv.Set([]byte("first"), value))
+	assert.Equal(t, PositionWindow, rkv.hpfile.Size())
+	require.NoError(t, rkv.Set([]byte("second"), []byte("2")))
+	assert.Equal(t, uint32(1), rkv.hb.Find(rkv.keyHash([]byte("second"))).Value)
+
+	const n = 500
+	for r := 0; r < 3; r++ {
+		for i := 0; i < n; i++ {
+			require.NoError(t, rkv.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d-%d", i, r))))
+		}
+	}
+	check := func() {
+		assert.Equal(t, string(value), getString(t, rkv, "first"))
+		assert.Equal(t, "2", getString(t, rkv, "second"))
+		for i := 0; i < n; i++ {
+			assert.Equal(t, fmt.Sprintf("value%d-2", i), getString(t, rkv, fmt.Sprintf("key%d", i)))
+		}
+	}
+	check()
+	size := rkv.hpfile.Size()
+	require.NoError(t, rkv.GabageCollect(size, size))
+	assert.True(t, rkv.hpfile.StartPos() >= PositionWindow)
+	check()
+	crash(rkv)
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	check()
+	require.NoError(t, rkv.Close())
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	check()
+	require.NoError(t, rkv.Close())
+}
+
+func TestPositionWindowFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	// fill the first block with a single slot
+	var value []byte
+	for {
+		slot := NewSlot([]byte("first"), value)
+		if _, n := slot.ToSlicesForDump(); n == 4096-16 {
+			break
+		}
+		value = append(value, 'v')
+	}
+	require.NoError(t, rkv.Set([]byte("first"), value))
+	require.NoError(t, rkv.Close())
+
+	// move the empty latest block as if the blocks before it had been written and pruned, such
+	// that only the reserved part of the window is left
+	layout := newDirLayout(dir)
+	tailID := (PositionWindow - positionReserve) / 4096
+	require.NoError(t, os.Rename(filepath.Join(layout.hpfDirName, "1-4096"),
+		filepath.Join(layout.hpfDirName, fmt.Sprintf("%d-4096", tailID))))
+
+	// the writes are refused without failing the RabbitKV, even after reopening
+	for i := 0; i < 2; i++ {
+		rkv, err = Open(dir, opts)
+		require.NoError(t, err)
+		assert.Equal(t, ErrPositionWindowFull, rkv.Set([]byte("second"), []byte("2")))
+		batch := rkv.NewBatch()
+		require.NoError(t, batch.Set([]byte("second"), []byte("2")))
+		assert.Equal(t, ErrPositionWindowFull, batch.Close())
+		assert.Equal(t, string(value), getString(t, rkv, "first"))
+		require.NoError(t, rkv.Close())
+	}
+
+	// garbage collection relocates the slots into the reserved part and prunes the head
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	require.Equal(t, ErrPositionWindowFull, rkv.Set([]byte("second"), []byte("2")))
+	require.NoError(t, rkv.GabageCollect(4096, 4096))
+	assert.Equal(t, tailID*4096, rkv.hpfile.StartPos())
+	require.NoError(t, rkv.Set([]byte("second"), []byte("2")))
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	assert.Equal(t, string(value), getString(t, rkv, "first"))
+	assert.Equal(t, "2", getString(t, rkv, "second"))
+	require.NoError(t, rkv.Close())
+}
@@ -0,0 +1,91 @@
+package rabbitkv
+
+import (
+	"encoding/binary"
+)
+
+// Return the position of the first slot which begins in the block 'id'. A block begins
+// with zero bytes which pad the overflowed tail of the last slot in the previous block,
+// and a slot's leading 4 bytes (its length) are never zero
+func (rkv *RabbitKV) firstSlotInBlock(id int) (int64, error) {
+	blockStart := int64(id) * int64(rkv.mi.blockSize)
+	fileSize, err := rkv.hpfile.blockFileSize(id)
+	if err != nil {
+		return 0, err
+	}
+	var buf [4]byte
+	off := int64(0)
+	for ; off+16 <= fileSize; off += 16 {
+		err = rkv.hpfile.ReadAt(buf[:], blockStart+off)
+		if err != nil {
+			return 0, err
+		}
+		if binary.LittleEndian.Uint32(buf[:]) != 0 {
+			break
+		}
+	}
+	return blockStart + off, nil
+}
+
+// Walk the slots in block 'id' from 'pos' and return the end of the last valid one, or the end
+// of the first slot which passes the end of this block
+func (rkv *RabbitKV) validSlotsEnd(id int, pos int64) (int64, error) {
+	blockStart := int64(id) * int64(rkv.mi.blockSize)
+	fileSize, err := rkv.hpfile.blockFileSize(id)
+	if err != nil {
+		return 0, err
+	}
+	for pos < blockStart+int64(rkv.mi.blockSize) && pos < blockStart+fileSize {
+		_, length, err := rkv.tryReadSlot(pos, blockStart+fileSize-pos)
+		if err != nil {
+			break // an incomplete or corrupt slot
+		}
+		pos += int64(length)
+	}
+	return pos, nil
+}
+
+// Remove the incomplete or corrupt slots at the end of the latest block, which are
+// left by a crash
+func (rkv *RabbitKV) recoverHPFileTail() error {
+	lastID := rkv.hpfile.largestID
+	blockStart := int64(lastID) * int64(rkv.mi.blockSize)
+	var start int64
+	var err error
+	if _, ok := rkv.hpfile.fileMap[lastID-1]; ok && lastID > 0 {
+		// the previous block was synced before the latest one was created, and the end of its
+		// last slot tells how many bytes are padded in the latest block
+		start, err = rkv.firstSlotInBlock(lastID - 1)
+		if err == nil {
+			start, err = rkv.validSlotsEnd(lastID-1, start)
+		}
+		if err == nil && start > rkv.hpfile.Size() {
+			err = rkv.hpfile.Truncate(start) // the padding is incomplete
+		}
+	} else if lastID == 0 {
+		start = 0
+	} else {
+		start, err = rkv.firstSlotInBlock(lastID)
+	}
+	if err != nil {
+		return err
+	}
+	if start < blockStart {
+		start = blockStart
+	}
+	end, err := rkv.validSlotsEnd(lastID, start)
+	if err != nil {
+		return err
+	}
+	if end < rkv.hpfile.Size() {
+		err = rkv.hpfile.Truncate(end)
+		if err != nil {
+			return err
+		}
+	}
+	blockEnd := blockStart + int64(rkv.mi.blockSize)
+	if end >= blockEnd { // crashed before the next block was created
+		return rkv.hpfile.addBlock(end - blockEnd)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package rabbitkv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// A range of HPFile which cannot be decoded. File is relative to the root directory
+type LostRegion struct {
+	File   string
+	Offset int64
+	Length int64
+}
+
+type RepairReport struct {
+	// The ranges discarded from HPFile, which are overwritten with empty slots, or truncated
+	// if they are at the end
+	LostRegions []LostRegion
+	// The hashes of the keys whose latest slots are lost, according to the old index logs. Only
+	// the hashes are known, except that the keys in an older slot of the same hash are listed in
+	// RevertedKeys, because their older values are kept
+	LostKeyHashes []uint64
+	RevertedKeys  [][]byte
+	// The old index logs are read completely. Otherwise LostKeyHashes may be incomplete and the
+	// deleted keys whose old slots are not collected yet may come back
+	IndexLogComplete bool
+	// The checksum of the old meta file is wrong, and its fields may be incorrect
+	CorruptMeta bool
+	// Number of the KV32 entries in the new index
+	EntryCount int
+}
+
+// Salvage the RabbitKV under 'dir', which cannot be opened because of the corrupt slots or
+// index-log entries. The index is rebuilt from HPFile by scanning the slots from the head and
+// keeping the last slot of each key hash, skipping the corrupt regions and resynchronizing on
+// the 16-byte alignment. Then fresh index logs and a new meta file are written. Only the seed
+// and the block size in the meta file are needed. The RabbitKV must not be in use
+func Repair(dir string) (*RepairReport, error) {
+	opts := DefaultOptions()
+	layout := newDirLayout(dir)
+	report := &RepairReport{}
+	rkv := &RabbitKV{opts: opts}
+	err := readMetaFile(layout.metaFile, &rkv.mi)
+	if errors.Is(err, ErrCorruptMeta) && rkv.mi.blockSize != 0 {
+		report.CorruptMeta, err = true, nil
+		rkv.mi.allAddrBits = initialAddrBits()
+		rkv.mi.nextGcPosition, rkv.mi.lastBatchSeq = 0, 0
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = checkFormatVersion(rkv.mi.formatVersion); err != nil {
+		return nil, err
+	}
+	rkv.hpfile, err = NewHPFile(int(rkv.mi.blockSize), layout.hpfDirName, false)
+	if err != nil {
+		return nil, err
+	}
+	defer rkv.hpfile.Close()
+	size := rkv.hpfile.Size()
+
+	// the old index tells the deleted keys and the lost ones, if it can be read
+	rkv.hb = NewHash3Bundle(rkv.mi.allAddrBits)
+	if ilog, err := NewIndexLogger(layout.idxDirName, opts.RetainedLogFiles, true); err == nil {
+		report.IndexLogComplete = rkv.verifyIndexLog(&ilog, size, &VerifyReport{})
+		ilog.Close()
+	}
+
+	// the live slots are after nextGcPosition, unless it is unknown
+	start, err := rkv.firstSlotInBlock(int(rkv.hpfile.StartPos() / int64(rkv.mi.blockSize)))
+	if err != nil {
+		return nil, err
+	}
+	type slotInfo struct {
+		pos    int64
+		length int
+		slot   Slot
+	}
+	latest := make(map[uint64]slotInfo)
+	end := start
+	var lostEnd int64 = -1
+	rkv.walkSlots(start, size, func(slot Slot, pos int64, length int) {
+		end = pos + int64(length)
+		if !slot.Empty() && pos >= int64(rkv.mi.nextGcPosition) {
+			latest[packKey64(rkv.slotKey64(&slot))] = slotInfo{pos, length, slot}
+		}
+	}, func(pos, next int64, _ error) {
+		file, off := rkv.hpfileLocation(pos)
+		report.LostRegions = append(report.LostRegions, LostRegion{file, off, next - pos})
+		if next == size {
+			lostEnd = pos
+		} else if err == nil {
+			err = rkv.fillEmptySlots(layout.hpfDirName, pos, next)
+		}
+		end = next
+	})
+
+	// the lost region at the end is truncated if possible, and the padding of an overflowed
+	// slot is completed, like recoverHPFileTail
+	if err == nil && lostEnd >= int64(rkv.hpfile.largestID)*int64(rkv.mi.blockSize) {
+		end = lostEnd
+		err = rkv.hpfile.Truncate(end)
+	} else if err == nil && lostEnd >= 0 {
+		err = rkv.fillEmptySlots(layout.hpfDirName, lostEnd, size)
+	}
+	if err == nil && end > size {
+		err = rkv.hpfile.Truncate(end)
+	}
+	if err == nil {
+		err = rkv.hpfile.Sync()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	oldHb := rkv.hb
+	rkv.hb = NewHash3Bundle(initialAddrBits())
+	nextGcPosition := end
+	var activeByteCount uint64
+	for key40, info := range latest {
+		key64 := unpackKey64(key40)
+		if report.IndexLogComplete && oldHb.lookup(key64) == 0 {
+			continue // deleted, whose old slot is not collected yet
+		}
+		rkv.hb.Set(key64, value32Of(info.pos))
+		activeByteCount += uint64(info.length)
+		if info.pos < nextGcPosition {
+			nextGcPosition = info.pos
+		}
+		report.EntryCount++
+	}
+	oldHb.Scan(func(key64 uint64, value uint32) {
+		pos := rkv.slotPos(value)
+		if pos >= size {
+			return // its slot was lost in a crash, which is not repaired here
+		}
+		info, ok := latest[packKey64(key64)]
+		if !ok {
+			report.LostKeyHashes = append(report.LostKeyHashes, key64)
+		} else if info.pos < pos {
+			for _, pair := range info.slot.pairs {
+				report.RevertedKeys = append(report.RevertedKeys, pair.key)
+			}
+		}
+	})
+
+	if err = rkv.writeFreshIndexLog(layout.idxDirName); err != nil {
+		return nil, err
+	}
+	rkv.mi.allAddrBits = rkv.hb.GetAllAddrBits()
+	rkv.mi.nextGcPosition = uint64(nextGcPosition)
+	rkv.mi.activeByteCount = activeByteCount
+	rkv.mi.closed = true
+	return report, writeMetaFile(layout.metaFile, &rkv.mi, os.O_RDWR|os.O_CREATE)
+}
+
+// Overwrite [start, end) of HPFile with empty slots. The block files other than the latest one are
+// opened read-only by HPFile, so they are opened again here
+func (rkv *RabbitKV) fillEmptySlots(hpfDirName string, start, end int64) error {
+	emptySlot := Slot{}
+	slices, length := emptySlot.ToSlicesForDump()
+	var unit []byte
+	for _, bz := range slices {
+		unit = append(unit, bz...)
+	}
+	blockSize := int64(rkv.mi.blockSize)
+	for pos := start; pos < end; {
+		// the bytes after the end of a block are read from the next block file
+		id := pos / blockSize
+		stop := (id + 1) * blockSize
+		if stop > end {
+			stop = end
+		}
+		buf := make([]byte, 0, stop-pos)
+		for i := pos; i < stop; i += int64(length) {
+			buf = append(buf, unit...)
+		}
+		fname := fmt.Sprintf("%s/%d-%d", hpfDirName, id, blockSize)
+		f, err := os.OpenFile(fname, os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(buf, pos%blockSize)
+		if err == nil {
+			err = f.Sync()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+		pos = stop
+	}
+	return nil
+}
+
+// Replace the index-log files with a new one, which dumps all the entries of Hash3Bundle. It is
+// written aside and then renamed, such that the old files are kept if it fails
+func (rkv *RabbitKV) writeFreshIndexLog(idxDirName string) error {
+	tmpDirName := idxDirName + ".repair"
+	if err := os.RemoveAll(tmpDirName); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDirName, 0700); err != nil {
+		return err
+	}
+	ilog, err := CreateIndexLogger(tmpDirName, rkv.opts.RetainedLogFiles)
+	if err != nil {
+		return err
+	}
+	rkv.hb.Scan(func(key64 uint64, value uint32) {
+		if err == nil {
+			_, err = ilog.Write(key64, value)
+		}
+	})
+	if err == nil {
+		err = ilog.Sync()
+	}
+	if e := ilog.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.RemoveAll(idxDirName)
+	}
+	if err == nil {
+		err = os.Rename(tmpDirName, idxDirName)
+	}
+	return err
+}
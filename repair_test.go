@@ -0,0 +1,68 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepair(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		require.NoError(t, rkv.Set([]byte(fmt.Sprintf("k%d", i%100)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	for i := 90; i < 100; i++ {
+		require.NoError(t, rkv.Delete([]byte(fmt.Sprintf("k%d", i))))
+	}
+	pos := rkv.slotPos(rkv.hb.lookup(rkv.keyHash([]byte("k5"))))
+	file, off := rkv.hpfileLocation(pos)
+	size := rkv.hpfile.Size()
+	require.NoError(t, rkv.Close())
+
+	// the key of a corrupt slot is reverted to its older slot
+	flipByte(t, filepath.Join(dir, file), off+16)
+	appendToFile(t, filepath.Join(dir, HPFileDirName, fmt.Sprintf("%d-4096", size/4096)), []byte{100, 0, 0, 0, 1})
+	report, err := Repair(dir)
+	require.NoError(t, err)
+	tailFile, tailOff := rkv.hpfileLocation(size)
+	assert.Equal(t, []LostRegion{{file, off, 32}, {tailFile, tailOff, 5}}, report.LostRegions)
+	assert.Equal(t, [][]byte{[]byte("k5")}, report.RevertedKeys)
+	assert.Empty(t, report.LostKeyHashes)
+	assert.Equal(t, 90, report.EntryCount)
+	assert.True(t, verify(t, dir).OK())
+
+	// nothing is lost, and the deleted keys do not come back
+	report, err = Repair(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &RepairReport{IndexLogComplete: true, EntryCount: 90}, report)
+
+	// the corrupt index log is rebuilt, but the deleted keys come back
+	flipByte(t, filepath.Join(dir, IndexDirName, "0"), 5)
+	_, err = Open(dir, opts)
+	assert.Error(t, err)
+	report, err = Repair(dir)
+	require.NoError(t, err)
+	assert.False(t, report.IndexLogComplete)
+	assert.Equal(t, 100, report.EntryCount)
+	assert.True(t, verify(t, dir).OK())
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "value105", getString(t, rkv, "k5"))
+	assert.Equal(t, "value206", getString(t, rkv, "k6"))
+	assert.Equal(t, "value299", getString(t, rkv, "k99"))
+	require.NoError(t, rkv.Set([]byte("k5"), []byte("new")))
+	require.NoError(t, rkv.GabageCollect(1<<20, 1<<20))
+	assert.Equal(t, "new", getString(t, rkv, "k5"))
+	require.NoError(t, rkv.Close())
+	assert.True(t, verify(t, dir).OK())
+}
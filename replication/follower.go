@@ -0,0 +1,222 @@
+package replication
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wide-key/RabbitKV"
+)
+
+// Follower keeps a local RabbitKV identical to the one of a leader. The local RabbitKV must
+// not be written by others, or else it diverges from the leader
+type Follower struct {
+	// accessed atomically, kept at the beginning for 64-bit alignment
+	appliedSeq uint64
+	leaderSeq  uint64
+
+	rkv  *rabbitkv.RabbitKV
+	conn net.Conn
+	done chan struct{}
+	mtx  sync.Mutex
+	err  error
+}
+
+// Connect to the leader at 'address' of 'network' (such as "tcp" or "unix") and start following
+// it. If there is no RabbitKV in 'dir', a checkpoint of the leader is downloaded into 'dir' first.
+// 'opts' is used to open the local RabbitKV
+func StartFollower(network, address, dir string, opts *rabbitkv.Options) (*Follower, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	if _, err = os.Stat(filepath.Join(dir, rabbitkv.MetaFileName)); os.IsNotExist(err) {
+		err = bootstrap(r, w, dir)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rkv, err := rabbitkv.Open(dir, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	f := &Follower{
+		appliedSeq: rkv.LatestVersion(),
+		leaderSeq:  rkv.LatestVersion(),
+		rkv:        rkv,
+		conn:       conn,
+		done:       make(chan struct{}),
+	}
+	err = w.WriteByte(reqStream)
+	if err == nil {
+		err = writeUint(w, 8, f.appliedSeq+1)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		rkv.Close()
+		return nil, err
+	}
+	go f.run(r)
+	return f, nil
+}
+
+// Download the files of a checkpoint into 'dir'
+func bootstrap(r *bufio.Reader, w *bufio.Writer, dir string) error {
+	err := w.WriteByte(reqBootstrap)
+	if err == nil {
+		err = writeUint(w, 8, 0)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	for err == nil {
+		var kind byte
+		if kind, err = r.ReadByte(); err != nil {
+			break
+		}
+		switch kind {
+		case msgFile:
+			err = receiveFile(r, dir)
+		case msgEnd:
+			return nil
+		case msgError:
+			err = readError(r)
+		default:
+			err = fmt.Errorf("Unexpected message %d", kind)
+		}
+	}
+	return err
+}
+
+func receiveFile(r *bufio.Reader, dir string) error {
+	name, err := readBytes(r, 2)
+	if err != nil {
+		return err
+	}
+	size, err := readUint(r, 8)
+	if err != nil {
+		return err
+	}
+	rel := filepath.Clean(filepath.FromSlash(string(name)))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("Invalid file name %s", name)
+	}
+	path := filepath.Join(dir, rel)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, r, int64(size))
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Apply the streamed batches until the connection is broken or an error happens
+func (f *Follower) run(r *bufio.Reader) {
+	defer close(f.done)
+	for {
+		kind, err := r.ReadByte()
+		if err == nil {
+			switch kind {
+			case msgBatch:
+				err = f.applyBatch(r)
+			case msgError:
+				err = readError(r)
+			default:
+				err = fmt.Errorf("Unexpected message %d", kind)
+			}
+		}
+		if err != nil {
+			f.mtx.Lock()
+			f.err = err
+			f.mtx.Unlock()
+			return
+		}
+	}
+}
+
+func (f *Follower) applyBatch(r *bufio.Reader) error {
+	changes, leaderSeq, err := readBatch(r)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return fmt.Errorf("Empty batch")
+	}
+	seq := changes[0].Seq
+	if seq != atomic.LoadUint64(&f.appliedSeq)+1 {
+		return fmt.Errorf("Batch %d is out of order after %d", seq, f.appliedSeq)
+	}
+	batch := f.rkv.NewBatch()
+	for _, c := range changes {
+		if c.Value == nil {
+			batch.Delete(c.Key)
+		} else if err = batch.Set(c.Key, c.Value); err != nil {
+			return err
+		}
+	}
+	if err = batch.Close(); err != nil {
+		return err
+	}
+	if f.rkv.LatestVersion() != seq {
+		return fmt.Errorf("The local RabbitKV diverges from the leader at batch %d", seq)
+	}
+	atomic.StoreUint64(&f.leaderSeq, leaderSeq)
+	atomic.StoreUint64(&f.appliedSeq, seq)
+	return nil
+}
+
+// The local RabbitKV, which should only be read
+func (f *Follower) DB() *rabbitkv.RabbitKV {
+	return f.rkv
+}
+
+// The sequence number of the last applied batch
+func (f *Follower) AppliedSeq() uint64 {
+	return atomic.LoadUint64(&f.appliedSeq)
+}
+
+// How many batches were committed by the leader but not applied yet, according to the latest
+// sequence number which the leader reported
+func (f *Follower) Lag() uint64 {
+	leaderSeq, appliedSeq := atomic.LoadUint64(&f.leaderSeq), atomic.LoadUint64(&f.appliedSeq)
+	if leaderSeq < appliedSeq {
+		return 0
+	}
+	return leaderSeq - appliedSeq
+}
+
+// Return the error which stopped following, or nil if it is still following. A broken
+// connection stops following, and so does Close
+func (f *Follower) Err() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.err
+}
+
+// Stop following and close the local RabbitKV
+func (f *Follower) Close() error {
+	f.conn.Close()
+	<-f.done
+	return f.rkv.Close()
+}
@@ -0,0 +1,176 @@
+package replication
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/wide-key/RabbitKV"
+)
+
+// Leader serves the followers which connect to its listener. The RabbitKV must be opened with
+// Options.ChangeLog enabled
+type Leader struct {
+	rkv   *rabbitkv.RabbitKV
+	ln    net.Listener
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// Start serving the followers which connect to 'ln'
+func NewLeader(rkv *rabbitkv.RabbitKV, ln net.Listener) *Leader {
+	l := &Leader{
+		rkv:   rkv,
+		ln:    ln,
+		conns: make(map[net.Conn]struct{}),
+	}
+	l.wg.Add(1)
+	go l.accept()
+	return l
+}
+
+func (l *Leader) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return // the listener is closed
+		}
+		l.mtx.Lock()
+		l.conns[conn] = struct{}{}
+		l.mtx.Unlock()
+		l.wg.Add(1)
+		go l.serve(conn)
+	}
+}
+
+// Stop accepting new followers and disconnect the existing ones. The RabbitKV is not closed
+func (l *Leader) Close() error {
+	err := l.ln.Close()
+	l.mtx.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mtx.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+func (l *Leader) serve(conn net.Conn) {
+	defer func() {
+		l.mtx.Lock()
+		delete(l.conns, conn)
+		l.mtx.Unlock()
+		conn.Close()
+		l.wg.Done()
+	}()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		seq, err := readUint(r, 8)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case reqBootstrap:
+			err = l.sendCheckpoint(w)
+		case reqStream:
+			err = l.stream(conn, w, seq)
+		default:
+			writeError(w, errUnknownRequest)
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+}
+
+// Write a checkpoint into a temporary directory and send all of its files, except the change
+// log, which is started afresh by a follower if it enables Options.ChangeLog
+func (l *Leader) sendCheckpoint(w *bufio.Writer) error {
+	tmpDir, err := ioutil.TempDir("", "rabbitkv-checkpoint")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	dir := filepath.Join(tmpDir, "db")
+	if err = l.rkv.Checkpoint(dir); err != nil {
+		return err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path == filepath.Join(dir, rabbitkv.ChangeLogDirName) {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return sendFile(w, filepath.ToSlash(name), path)
+	})
+	if err != nil {
+		return err
+	}
+	if err = w.WriteByte(msgEnd); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func sendFile(w *bufio.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = w.WriteByte(msgFile)
+	if err == nil {
+		err = writeBytes(w, 2, []byte(name))
+	}
+	if err == nil {
+		err = writeUint(w, 8, uint64(info.Size()))
+	}
+	if err == nil {
+		_, err = w.ReadFrom(f)
+	}
+	return err
+}
+
+// Send the batches from 'seq' on, until the follower disconnects
+func (l *Leader) stream(conn net.Conn, w *bufio.Writer, seq uint64) error {
+	sub, err := l.rkv.Subscribe(seq)
+	if err != nil {
+		return err
+	}
+	// the follower sends nothing while streaming, so a read returns when it disconnects
+	go func() {
+		var buf [1]byte
+		conn.Read(buf[:])
+		sub.Close()
+	}()
+	defer sub.Close()
+	for {
+		changes, err := sub.Next()
+		if err != nil {
+			return err
+		}
+		if err = writeBatch(w, changes, l.rkv.LatestVersion()); err != nil {
+			return err
+		}
+	}
+}
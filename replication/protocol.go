@@ -0,0 +1,177 @@
+// Package replication keeps follower copies of a RabbitKV up to date by streaming the
+// committed batches from the change log of the leader.
+//
+// A follower sends requests to the leader and the leader answers with messages:
+//
+//	request:   [kind byte][seq uint64]
+//	file:      [msgFile][len uint16][name][size uint64][content]
+//	end:       [msgEnd]
+//	batch:     [msgBatch][seq uint64][leaderSeq uint64][count uint32]([op byte][len uint32][key]([len uint32][value]))*
+//	error:     [msgError][len uint16][text]
+//
+// A reqBootstrap request is answered by the files of a checkpoint and an end message, and a
+// reqStream request is answered by the batches from 'seq' on, endlessly.
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/wide-key/RabbitKV"
+)
+
+const (
+	reqBootstrap = 1
+	reqStream    = 2
+
+	msgFile  = 1
+	msgEnd   = 2
+	msgBatch = 3
+	msgError = 4
+
+	opDelete = 0
+	opSet    = 1
+
+	// At most this many bytes are allocated by readBytes before they are received
+	maxPreallocBytes = 64 * 1024
+)
+
+var (
+	// ErrLeader wraps the errors reported by the leader
+	ErrLeader         = errors.New("Leader error")
+	errUnknownRequest = errors.New("Unknown request")
+)
+
+func writeUint(w *bufio.Writer, n int, v uint64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	_, err := w.Write(buf[8-n:])
+	return err
+}
+
+func readUint(r *bufio.Reader, n int) (uint64, error) {
+	var buf [8]byte
+	_, err := io.ReadFull(r, buf[8-n:])
+	return binary.BigEndian.Uint64(buf[:]), err
+}
+
+func writeBytes(w *bufio.Writer, n int, bz []byte) error {
+	if err := writeUint(w, n, uint64(len(bz))); err != nil {
+		return err
+	}
+	_, err := w.Write(bz)
+	return err
+}
+
+// The length is read from the peer, so the buffer only grows with the bytes actually received,
+// instead of being allocated with a corrupt length at once
+func readBytes(r *bufio.Reader, n int) ([]byte, error) {
+	length, err := readUint(r, n)
+	if err != nil {
+		return nil, err
+	}
+	capacity := length
+	if capacity > maxPreallocBytes {
+		capacity = maxPreallocBytes
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, capacity))
+	_, err = io.CopyN(buf, r, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+func writeError(w *bufio.Writer, e error) error {
+	msg := e.Error()
+	if len(msg) > 0xFFFF {
+		msg = msg[:0xFFFF]
+	}
+	if err := w.WriteByte(msgError); err != nil {
+		return err
+	}
+	if err := writeBytes(w, 2, []byte(msg)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Read the text of an error message, whose kind byte has been read
+func readError(r *bufio.Reader) error {
+	msg, err := readBytes(r, 2)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrLeader, msg)
+}
+
+func writeBatch(w *bufio.Writer, changes []rabbitkv.Change, leaderSeq uint64) error {
+	err := w.WriteByte(msgBatch)
+	if err == nil {
+		err = writeUint(w, 8, changes[0].Seq)
+	}
+	if err == nil {
+		err = writeUint(w, 8, leaderSeq)
+	}
+	if err == nil {
+		err = writeUint(w, 4, uint64(len(changes)))
+	}
+	for _, c := range changes {
+		if err != nil {
+			return err
+		}
+		if c.Value == nil {
+			err = w.WriteByte(opDelete)
+		} else {
+			err = w.WriteByte(opSet)
+		}
+		if err == nil {
+			err = writeBytes(w, 4, c.Key)
+		}
+		if err == nil && c.Value != nil {
+			err = writeBytes(w, 4, c.Value)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Read a batch message, whose kind byte has been read
+func readBatch(r *bufio.Reader) (changes []rabbitkv.Change, leaderSeq uint64, err error) {
+	seq, err := readUint(r, 8)
+	if err != nil {
+		return
+	}
+	if leaderSeq, err = readUint(r, 8); err != nil {
+		return
+	}
+	count, err := readUint(r, 4)
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < count; i++ {
+		c := rabbitkv.Change{Seq: seq}
+		var op byte
+		if op, err = r.ReadByte(); err != nil {
+			return
+		}
+		if c.Key, err = readBytes(r, 4); err != nil {
+			return
+		}
+		if op == opSet {
+			if c.Value, err = readBytes(r, 4); err != nil {
+				return
+			}
+		} else if op != opDelete {
+			return nil, 0, fmt.Errorf("Unknown operation %d", op)
+		}
+		changes = append(changes, c)
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/wide-key/RabbitKV"
+)
+
+func dump(t *testing.T, rkv *rabbitkv.RabbitKV) map[string]string {
+	res := make(map[string]string)
+	require.NoError(t, rkv.ForEach(func(key, value []byte) bool {
+		res[string(key)] = string(value)
+		return true
+	}))
+	return res
+}
+
+func writeBatches(t *testing.T, rkv *rabbitkv.RabbitKV, from, to int) {
+	for i := from; i < to; i++ {
+		batch := rkv.NewBatch()
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%d", i%50)), []byte(fmt.Sprint(i))))
+		require.NoError(t, batch.Set([]byte(fmt.Sprintf("other%d", i)), []byte("")))
+		batch.Delete([]byte(fmt.Sprintf("other%d", i-10)))
+		require.NoError(t, batch.Close())
+	}
+}
+
+func waitForSync(t *testing.T, leader *rabbitkv.RabbitKV, f *Follower) {
+	deadline := time.Now().Add(5 * time.Second)
+	for f.AppliedSeq() < leader.LatestVersion() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.NoError(t, f.Err())
+	require.Equal(t, leader.LatestVersion(), f.AppliedSeq())
+	assert.Equal(t, uint64(0), f.Lag())
+	assert.Equal(t, dump(t, leader), dump(t, f.DB()))
+}
+
+func testReplication(t *testing.T, network, address string) {
+	dir, err := ioutil.TempDir("", "replication")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	leaderDir, followerDir := filepath.Join(dir, "leader"), filepath.Join(dir, "follower")
+	opts := &rabbitkv.Options{BlockSize: 4096, ChangeLog: true}
+
+	rkv, err := rabbitkv.CreateRabbitKV(leaderDir, opts)
+	require.NoError(t, err)
+	defer rkv.Close()
+	writeBatches(t, rkv, 0, 100)
+	ln, err := net.Listen(network, address)
+	require.NoError(t, err)
+	leader := NewLeader(rkv, ln)
+	defer leader.Close()
+
+	// bootstrap from a checkpoint
+	f, err := StartFollower(network, ln.Addr().String(), followerDir, opts)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), f.AppliedSeq())
+	waitForSync(t, rkv, f)
+	writeBatches(t, rkv, 100, 300)
+	waitForSync(t, rkv, f)
+	require.NoError(t, f.Close())
+
+	// resume from the local RabbitKV
+	writeBatches(t, rkv, 300, 400)
+	f, err = StartFollower(network, ln.Addr().String(), followerDir, opts)
+	require.NoError(t, err)
+	waitForSync(t, rkv, f)
+	require.NoError(t, leader.Close())
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Error(t, f.Err())
+	require.NoError(t, f.Close())
+}
+
+func TestReplicationUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testReplication(t, "unix", filepath.Join(dir, "leader.sock"))
+}
+
+func TestReplicationTCP(t *testing.T) {
+	testReplication(t, "tcp", "127.0.0.1:0")
+}
+
+func TestLeaderError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replication")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rkv, err := rabbitkv.CreateRabbitKV(filepath.Join(dir, "leader"), &rabbitkv.Options{BlockSize: 4096})
+	require.NoError(t, err)
+	defer rkv.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	leader := NewLeader(rkv, ln)
+	defer leader.Close()
+
+	// the change log is not enabled
+	f, err := StartFollower("tcp", ln.Addr().String(), filepath.Join(dir, "follower"), nil)
+	require.NoError(t, err)
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, errors.Is(f.Err(), ErrLeader))
+	require.NoError(t, f.Close())
+}
+
+func TestReadBytes(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	require.NoError(t, writeBytes(w, 4, []byte{}))
+	require.NoError(t, writeBytes(w, 4, []byte("value")))
+	require.NoError(t, writeUint(w, 4, 0xFFFFFFFF)) // a corrupt length
+	_, err := w.Write([]byte("short"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+
+	r := bufio.NewReader(&buf)
+	bz, err := readBytes(r, 4)
+	require.NoError(t, err)
+	assert.NotNil(t, bz)
+	assert.Empty(t, bz)
+	bz, err = readBytes(r, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value"), bz)
+	_, err = readBytes(r, 4)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
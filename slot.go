@@ -2,8 +2,8 @@ package rabbitkv
 
 import (
 	"bytes"
-	"errors"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/mmcloughlin/meow"
 )
@@ -18,8 +18,8 @@ type Slot struct {
 }
 
 func NewSlot(key, value []byte) Slot {
-	return Slot {
-		pairs: []Pair {
+	return Slot{
+		pairs: []Pair{
 			{key: key, value: value},
 		},
 	}
@@ -66,7 +66,8 @@ func (s *Slot) Remove(key []byte) (existed bool) {
 	return true
 }
 
-//total-length, pair-count, lengths-of-kv, payload-of-kv, cksum, padding
+// total-length, pair-count, lengths-of-kv, payload-of-kv, cksum, padding
+// total-length does not include itself, and the returned length includes all the bytes
 func (s *Slot) ToSlicesForDump() ([][]byte, int) {
 	hasher := meow.New32(0)
 	head := make([]byte, 4, (len(s.pairs)*2+2)*4)
@@ -81,7 +82,7 @@ func (s *Slot) ToSlicesForDump() ([][]byte, int) {
 			head = append(head, buf[:]...)
 		}
 	}
-	totalLen := len(head)-4 //exclude the leading 4 bytes
+	totalLen := len(head) - 4 //exclude the leading 4 bytes
 
 	res := make([][]byte, 0, len(s.pairs)*2+3)
 	res = append(res, head)
@@ -94,27 +95,28 @@ func (s *Slot) ToSlicesForDump() ([][]byte, int) {
 	}
 	binary.LittleEndian.PutUint32(buf[:], hasher.Sum32())
 	res = append(res, buf[:])
-	binary.LittleEndian.PutUint32(head[:4], uint32(totalLen))
-	rem := (totalLen+4)%16 //include the leading 4 bytes
+	totalLen += 4              //the cksum
+	rem := (totalLen + 4) % 16 //include the leading 4 bytes
 	if rem == 0 {
 		res = append(res, []byte{}) //no padding
 	} else {
-		res = append(res, make([]byte, 16 - rem)) //padding
+		res = append(res, make([]byte, 16-rem)) //padding
 		totalLen += 16 - rem
 	}
-	return res, totalLen
+	binary.LittleEndian.PutUint32(head[:4], uint32(totalLen))
+	return res, totalLen + 4 //include the leading 4 bytes
 }
 
 func extractBytes(in []byte, length int) (result, out []byte, err error) {
 	if len(in) < length {
-		return nil, nil, errors.New("Not enough bytes to read")
+		return nil, nil, fmt.Errorf("%w: not enough bytes to read", ErrCorruptSlot)
 	}
 	return in[:length], in[length:], nil
 }
 
 func extractUint32(in []byte) (result uint32, out []byte, err error) {
 	if len(in) < 4 {
-		return 0, nil, errors.New("Not enough bytes to read")
+		return 0, nil, fmt.Errorf("%w: not enough bytes to read", ErrCorruptSlot)
 	}
 	return binary.LittleEndian.Uint32(in[:4]), in[4:], nil
 }
@@ -125,6 +127,10 @@ func BytesToSlot(bzIn []byte) (slot Slot, err error) {
 		return
 	}
 
+	if int64(pairCount)*8 > int64(len(bz)) {
+		err = fmt.Errorf("%w: too many pairs", ErrCorruptSlot)
+		return
+	}
 	lenList := make([]uint32, 2*int(pairCount))
 	for i := range lenList {
 		lenList[i], bz, err = extractUint32(bz)
@@ -149,12 +155,11 @@ func BytesToSlot(bzIn []byte) (slot Slot, err error) {
 	}
 
 	hasher := meow.New32(0)
-	hasher.Write(bzIn[:len(bzIn)-len(bz)/*padding*/-4/*cksum*/])
+	hasher.Write(bzIn[:len(bzIn)-len(bz) /*padding*/ -4 /*cksum*/])
 	if hasher.Sum32() != cksum {
-		err = errors.New("Checksum Error")
+		err = fmt.Errorf("%w: checksum error", ErrCorruptSlot)
 		return
 	}
 
 	return
 }
-
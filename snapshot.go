@@ -0,0 +1,109 @@
+package rabbitkv
+
+// Snapshot is a read-only view of a RabbitKV as of its creation, which is not affected by the
+// following writes. The Hash3 shards are shared with the RabbitKV and copied on write, and the
+// slots it refers to are not pruned until it is released
+type Snapshot struct {
+	rkv         *RabbitKV
+	hb          Hash3Bundle
+	orderedRoot *treapNode
+	pinPos      int64
+	released    bool
+}
+
+func (rkv *RabbitKV) NewSnapshot() (*Snapshot, error) {
+	rkv.mtx.Lock()
+	defer rkv.mtx.Unlock()
+	if rkv.isClosed {
+		return nil, ErrClosed
+	}
+	// all the active slots are after nextGcPosition
+	snap := &Snapshot{
+		rkv:         rkv,
+		hb:          rkv.hb.snapshot(),
+		orderedRoot: rkv.orderedRoot,
+		pinPos:      int64(rkv.mi.nextGcPosition),
+	}
+	if rkv.pins == nil {
+		rkv.pins = make(map[int64]int)
+	}
+	rkv.pins[snap.pinPos]++
+	return snap, nil
+}
+
+// Return the position before which the blocks can be pruned, 'mtx' must be locked
+func (rkv *RabbitKV) pruneLimit() int64 {
+	limit := int64(rkv.mi.nextGcPosition)
+	for pos := range rkv.pins {
+		if pos < limit {
+			limit = pos
+		}
+	}
+	if rkv.history != nil {
+		limit = rkv.history.minPos(limit, rkv.hpfile.StartPos())
+	}
+	return limit
+}
+
+// Release the snapshot such that its slots can be pruned. It must not be used any more
+func (snap *Snapshot) Release() {
+	rkv := snap.rkv
+	rkv.mtx.Lock()
+	defer rkv.mtx.Unlock()
+	if snap.released {
+		return
+	}
+	snap.released = true
+	snap.hb = Hash3Bundle{}
+	snap.orderedRoot = nil
+	if rkv.pins[snap.pinPos]--; rkv.pins[snap.pinPos] == 0 {
+		delete(rkv.pins, snap.pinPos)
+	}
+}
+
+// Return the value of 'key' as of the creation of the snapshot, or nil if it did not exist
+func (snap *Snapshot) Get(key []byte) ([]byte, error) {
+	rkv := snap.rkv
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	if err := snap.check(); err != nil {
+		return nil, err
+	}
+	return rkv.getFrom(&snap.hb, key)
+}
+
+// Return an error if the snapshot cannot be read, 'mtx' must be read-locked
+func (snap *Snapshot) check() error {
+	if snap.rkv.isClosed {
+		return ErrClosed
+	}
+	if snap.released {
+		return ErrReleased
+	}
+	return nil
+}
+
+// Same as RabbitKV.Iterator, but visits the keys as of the creation of the snapshot
+func (snap *Snapshot) Iterator(start, end []byte) (*Iterator, error) {
+	rkv := snap.rkv
+	rkv.mtx.RLock()
+	if err := snap.check(); err != nil {
+		rkv.mtx.RUnlock()
+		return nil, err
+	}
+	if !rkv.opts.OrderedIndex {
+		rkv.mtx.RUnlock()
+		return nil, ErrNoOrderedIndex
+	}
+	iter := &Iterator{
+		get:    snap.Get,
+		cursor: newTreapCursor(snap.orderedRoot, start, end),
+	}
+	rkv.mtx.RUnlock()
+	iter.loadValue()
+	return iter, nil
+}
+
+func (snap *Snapshot) PrefixIterator(prefix []byte) (*Iterator, error) {
+	return snap.Iterator(prefix, prefixEnd(prefix))
+}
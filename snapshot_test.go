@@ -0,0 +1,76 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func snapString(t *testing.T, snap *Snapshot, key string) string {
+	v, err := snap.Get([]byte(key))
+	require.NoError(t, err)
+	return string(v)
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1, OrderedIndex: true}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	overwrite(t, rkv, 1)
+	require.NoError(t, rkv.Set([]byte("a"), []byte("1")))
+	snap, err := rkv.NewSnapshot()
+	require.NoError(t, err)
+
+	require.NoError(t, rkv.Set([]byte("a"), []byte("2")))
+	require.NoError(t, rkv.Set([]byte("b"), []byte("2")))
+	require.NoError(t, rkv.Delete([]byte("key0")))
+	// enlarge the shards
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, rkv.Set([]byte(fmt.Sprintf("new%d", i)), []byte("v")))
+	}
+	assert.Equal(t, "1", snapString(t, snap, "a"))
+	assert.Equal(t, "", snapString(t, snap, "b"))
+	assert.Equal(t, "value0-0", snapString(t, snap, "key0"))
+	assert.Equal(t, "", snapString(t, snap, "new1"))
+	assert.Equal(t, "2", getString(t, rkv, "a"))
+	assert.Equal(t, "", getString(t, rkv, "key0"))
+
+	iter, err := snap.PrefixIterator([]byte("key9"))
+	assert.Equal(t, []string{"key9=value9-0", "key90=value90-0", "key91=value91-0", "key92=value92-0",
+		"key93=value93-0", "key94=value94-0", "key95=value95-0", "key96=value96-0", "key97=value97-0",
+		"key98=value98-0", "key99=value99-0"}, iterKeys(t, iter, err))
+
+	// the slots referred by the snapshot are not pruned
+	require.NoError(t, rkv.GabageCollect(1<<30, 1<<30))
+	assert.True(t, rkv.mi.nextGcPosition > 4096)
+	assert.Equal(t, int64(0), rkv.hpfile.StartPos())
+	assert.Equal(t, "1", snapString(t, snap, "a"))
+	for i := 1; i < 100; i++ {
+		assert.Equal(t, fmt.Sprintf("value%d-0", i), snapString(t, snap, fmt.Sprintf("key%d", i)))
+	}
+
+	snap.Release()
+	snap.Release()
+	_, err = snap.Get([]byte("a"))
+	assert.Equal(t, ErrReleased, err)
+	_, err = snap.Iterator(nil, nil)
+	assert.Equal(t, ErrReleased, err)
+	require.NoError(t, rkv.GabageCollect(1<<30, 1<<30))
+	assert.True(t, rkv.hpfile.StartPos() > 0)
+	assert.Equal(t, "2", getString(t, rkv, "a"))
+	assert.Equal(t, "v", getString(t, rkv, "new1"))
+
+	snap, err = rkv.NewSnapshot()
+	require.NoError(t, err)
+	require.NoError(t, rkv.Close())
+	_, err = snap.Get([]byte("a"))
+	assert.Equal(t, ErrClosed, err)
+	_, err = rkv.NewSnapshot()
+	assert.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,72 @@
+package rabbitkv
+
+// A point-in-time report of the space usage
+type Stats struct {
+	// Total length of the active slots
+	ActiveBytes uint64
+	// The end of HPFile, counting the pruned blocks
+	HPFileSize int64
+	// The start of the first block which is not pruned
+	HeadPosition int64
+	// Garbage collection has handled the slots before this position
+	NextGcPosition uint64
+	// Number of the HPFile blocks which are not pruned
+	BlockCount int
+	// Sizes of the retained index-log files, from the oldest to the latest
+	IndexLogFileSizes []int64
+	// The addrBits and the count of valid entries of every Hash3 in Hash3Bundle
+	ShardAddrBits [256]byte
+	ShardEntries  [256]int
+	// How many slots and bytes are copied by garbage collection since opened
+	GCRelocations    uint64
+	GCRelocatedBytes uint64
+	// How many times HPFile.PruneHead is called and how many blocks are removed since opened
+	GCPrunes       uint64
+	GCPrunedBlocks uint64
+}
+
+// The bytes kept on the disk for the slots, divided by the bytes of the active slots
+func (s *Stats) SpaceAmplification() float64 {
+	if s.ActiveBytes == 0 {
+		return 0
+	}
+	return float64(s.HPFileSize-s.HeadPosition) / float64(s.ActiveBytes)
+}
+
+func (s *Stats) IndexLogBytes() (n int64) {
+	for _, size := range s.IndexLogFileSizes {
+		n += size
+	}
+	return
+}
+
+func (rkv *RabbitKV) Stats() (*Stats, error) {
+	rkv.wmtx.Lock() // for reading the index log
+	defer rkv.wmtx.Unlock()
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	if rkv.isClosed {
+		return nil, ErrClosed
+	}
+	sizes, err := rkv.ilog.FileSizes()
+	if err != nil {
+		return nil, err
+	}
+	s := &Stats{
+		ActiveBytes:       rkv.mi.activeByteCount,
+		HPFileSize:        rkv.hpfile.Size(),
+		HeadPosition:      rkv.hpfile.StartPos(),
+		NextGcPosition:    rkv.mi.nextGcPosition,
+		BlockCount:        rkv.hpfile.BlockCount(),
+		IndexLogFileSizes: sizes,
+		ShardAddrBits:     rkv.hb.GetAllAddrBits(),
+		GCRelocations:     rkv.gcRelocations,
+		GCRelocatedBytes:  rkv.gcRelocatedBytes,
+		GCPrunes:          rkv.gcPrunes,
+		GCPrunedBlocks:    rkv.gcPrunedBlocks,
+	}
+	for i := range rkv.hb.arr {
+		s.ShardEntries[i] = rkv.hb.shardLen(i)
+	}
+	return s, nil
+}
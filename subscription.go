@@ -0,0 +1,154 @@
+package rabbitkv
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Subscription reads the changes of the committed batches from the change log, in the order
+// of their sequence numbers. Next must not be called concurrently
+type Subscription struct {
+	rkv      *RabbitKV
+	nextSeq  uint64
+	mtx      sync.Mutex // protect the fields below against Close
+	file     *os.File
+	fileSeq  uint64 // the first sequence number of 'file'
+	off      int64
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Subscribe to the changes of the batches whose sequence numbers are not less than 'fromSeq'.
+// Options.ChangeLog must be enabled
+func (rkv *RabbitKV) Subscribe(fromSeq uint64) (*Subscription, error) {
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	if rkv.isClosed {
+		return nil, ErrClosed
+	}
+	if rkv.changes == nil {
+		return nil, ErrNoChangeLog
+	}
+	if fromSeq == 0 {
+		fromSeq = 1
+	}
+	if fromSeq < rkv.changes.seqs()[0] {
+		return nil, ErrChangeUnavailable
+	}
+	return &Subscription{rkv: rkv, nextSeq: fromSeq, done: make(chan struct{})}, nil
+}
+
+// Return the changes of the next committed batch, waiting until it is committed. ErrClosed is
+// returned when the RabbitKV or the subscription is closed, and ErrChangeUnavailable is returned
+// when the changes were not recorded or have been removed
+func (sub *Subscription) Next() ([]Change, error) {
+	for {
+		rkv := sub.rkv
+		rkv.mtx.RLock()
+		closed, lastSeq, notify := rkv.isClosed, rkv.mi.lastBatchSeq, rkv.changeNotify
+		var fileSeqs []uint64
+		if !closed {
+			fileSeqs = rkv.changes.seqs()
+		}
+		rkv.mtx.RUnlock()
+		if closed {
+			return nil, ErrClosed
+		}
+		if sub.nextSeq > lastSeq {
+			select {
+			case <-notify:
+				continue
+			case <-sub.done:
+				return nil, ErrClosed
+			}
+		}
+		sub.mtx.Lock()
+		var changes []Change
+		var err error
+		select {
+		case <-sub.done:
+			err = ErrClosed
+		default:
+			changes, err = sub.read(fileSeqs)
+		}
+		sub.mtx.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if changes != nil {
+			sub.nextSeq++
+			return changes, nil
+		}
+	}
+}
+
+// Read the record of nextSeq, which has been committed. Return nil if another file should be tried
+func (sub *Subscription) read(fileSeqs []uint64) ([]Change, error) {
+	if sub.file == nil {
+		// open the last file which may contain nextSeq
+		i := len(fileSeqs) - 1
+		for i >= 0 && fileSeqs[i] > sub.nextSeq {
+			i--
+		}
+		if i < 0 {
+			return nil, ErrChangeUnavailable
+		}
+		if err := sub.open(fileSeqs[i]); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		seq, changes, length, err := readChangeRecord(sub.file, sub.off)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		sub.off += length
+		if seq == sub.nextSeq {
+			return changes, nil
+		} else if seq > sub.nextSeq {
+			return nil, ErrChangeUnavailable
+		}
+	}
+	// the end of this file, so nextSeq must be at the beginning of the next file
+	for _, fileSeq := range fileSeqs {
+		if fileSeq > sub.fileSeq {
+			if fileSeq != sub.nextSeq {
+				return nil, ErrChangeUnavailable
+			}
+			return nil, sub.open(fileSeq)
+		}
+	}
+	return nil, ErrChangeUnavailable
+}
+
+func (sub *Subscription) open(fileSeq uint64) error {
+	f, err := os.Open(changeLogFileName(sub.rkv.changes.dirName, fileSeq))
+	if os.IsNotExist(err) {
+		return ErrChangeUnavailable // removed after fileSeqs was copied
+	} else if err != nil {
+		return err
+	}
+	if sub.file != nil {
+		sub.file.Close()
+	}
+	sub.file, sub.fileSeq, sub.off = f, fileSeq, 0
+	return nil
+}
+
+// Close the subscription, and a blocked Next returns ErrClosed
+func (sub *Subscription) Close() error {
+	sub.doneOnce.Do(func() {
+		close(sub.done)
+	})
+	sub.mtx.Lock()
+	defer sub.mtx.Unlock()
+	if sub.file == nil {
+		return nil
+	}
+	err := sub.file.Close()
+	sub.file = nil
+	return err
+}
@@ -0,0 +1,226 @@
+package rabbitkv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// An inconsistency found by Verify. File is relative to the root directory, and Offset is the
+// offset in File, or -1 if it is about the whole file
+type Problem struct {
+	File   string
+	Offset int64
+	Msg    string
+}
+
+func (p Problem) String() string {
+	if p.Offset < 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Msg)
+	}
+	return fmt.Sprintf("%s at %d: %s", p.File, p.Offset, p.Msg)
+}
+
+type VerifyReport struct {
+	Problems []Problem
+	// Number of the valid slots in HPFile, and the KV32 entries in Hash3Bundle
+	SlotCount  int
+	EntryCount int
+	// Total length of the slots which the KV32 entries point at
+	ActiveByteCount uint64
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) add(file string, offset int64, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{File: file, Offset: offset, Msg: fmt.Sprintf(format, args...)})
+}
+
+// The block file holding 'pos' and the offset in it
+func (rkv *RabbitKV) hpfileLocation(pos int64) (string, int64) {
+	blockSize := int64(rkv.mi.blockSize)
+	return filepath.Join(HPFileDirName, fmt.Sprintf("%d-%d", pos/blockSize, blockSize)), pos % blockSize
+}
+
+// Walk the slots in [start, end). When the slot at a position cannot be read, the following
+// positions are tried 16 bytes by 16 bytes until a valid slot is found, and 'onCorrupt' is
+// called with the skipped range [pos, next) and the error at 'pos'
+func (rkv *RabbitKV) walkSlots(start, end int64, fn func(slot Slot, pos int64, length int),
+	onCorrupt func(pos, next int64, err error)) {
+	for pos := start; pos < end; {
+		slot, length, err := rkv.tryReadSlot(pos, end-pos)
+		if err == nil {
+			fn(slot, pos, length)
+			pos += int64(length)
+			continue
+		}
+		next := pos + 16
+		for ; next < end; next += 16 {
+			if _, _, e := rkv.tryReadSlot(next, end-next); e == nil {
+				break
+			}
+		}
+		if next > end {
+			next = end
+		}
+		onCorrupt(pos, next, err)
+		pos = next
+	}
+}
+
+// Check the RabbitKV under 'dir' without modifying it, and report all the inconsistencies found
+// in its meta file, HPFile and index-log files. It must not be opened for writing by others.
+// Only Options.RetainedLogFiles is used. An error is returned only if it cannot be checked at all
+func Verify(dir string, opts *Options) (*VerifyReport, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	layout := newDirLayout(dir)
+	report := &VerifyReport{}
+	rkv := &RabbitKV{opts: opts}
+	err = readMetaFile(layout.metaFile, &rkv.mi)
+	if errors.Is(err, ErrCorruptMeta) && rkv.mi.blockSize != 0 {
+		// the fields are decoded, and go on checking with them
+		report.add(MetaFileName, MetaInfoBytes-4, "%v", err)
+		rkv.mi.allAddrBits, err = initialAddrBits(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = checkFormatVersion(rkv.mi.formatVersion); err != nil {
+		return nil, err
+	}
+	rkv.hpfile, err = NewHPFile(int(rkv.mi.blockSize), layout.hpfDirName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer rkv.hpfile.Close()
+
+	// walk the slots from the head, whose block may begin with the tail of a pruned slot
+	size := rkv.hpfile.Size()
+	start, err := rkv.firstSlotInBlock(int(rkv.hpfile.StartPos() / int64(rkv.mi.blockSize)))
+	if err != nil {
+		return nil, err
+	}
+	latestBlockStart := int64(rkv.hpfile.largestID) * int64(rkv.mi.blockSize)
+	type slotInfo struct {
+		key64  uint64
+		length int
+	}
+	slots := make(map[int64]slotInfo)
+	rkv.walkSlots(start, size, func(slot Slot, pos int64, length int) {
+		report.SlotCount++
+		if slot.Empty() {
+			return
+		}
+		key64 := rkv.slotKey64(&slot)
+		for _, pair := range slot.pairs[1:] {
+			if packKey64(rkv.keyHash(pair.key)) != packKey64(key64) {
+				file, off := rkv.hpfileLocation(pos)
+				report.add(file, off, "Pairs of different key hashes in a slot")
+				break
+			}
+		}
+		slots[pos] = slotInfo{key64, length}
+	}, func(pos, next int64, err error) {
+		if next == size && !rkv.mi.closed && pos >= latestBlockStart {
+			return // left by a crash, and will be removed by recovery
+		}
+		file, off := rkv.hpfileLocation(pos)
+		report.add(file, off, "%d bytes skipped: %v", next-pos, err)
+	})
+
+	ilog, err := NewIndexLogger(layout.idxDirName, opts.RetainedLogFiles, true)
+	if err != nil {
+		return nil, err
+	}
+	defer ilog.Close()
+	rkv.hb = NewHash3Bundle(rkv.mi.allAddrBits)
+	indexComplete := rkv.verifyIndexLog(&ilog, size, report)
+
+	// every KV32 entry must point at a slot of its key
+	rkv.hb.Scan(func(key64 uint64, value uint32) {
+		report.EntryCount++
+		pos := rkv.slotPos(value)
+		file, off := rkv.hpfileLocation(pos)
+		info, ok := slots[pos]
+		if !ok {
+			report.add(file, off, "KV32 entry of key %#x points at no valid slot", key64)
+			return
+		}
+		if packKey64(info.key64) != packKey64(key64) {
+			report.add(file, off, "KV32 entry of key %#x points at a slot of key %#x", key64, info.key64)
+			return
+		}
+		if pos < int64(rkv.mi.nextGcPosition) {
+			report.add(file, off, "Active slot is before nextGcPosition %d", rkv.mi.nextGcPosition)
+		}
+		report.ActiveByteCount += uint64(info.length)
+	})
+	// the meta file is only up to date when closed properly
+	if indexComplete && rkv.mi.closed && report.ActiveByteCount != rkv.mi.activeByteCount {
+		report.add(MetaFileName, 256+8, "activeByteCount is %d, but the active slots have %d bytes",
+			rkv.mi.activeByteCount, report.ActiveByteCount)
+	}
+	return report, nil
+}
+
+// Replay the index-log files into Hash3Bundle like load, and report the corrupt entries. The
+// replaying stops at the first corrupt entry, and false is returned in that case. Also used by
+// Repair to read the old index
+func (rkv *RabbitKV) verifyIndexLog(ilog *IndexLogger, size int64, report *VerifyReport) bool {
+	r := &logReplayer{fn: func(key uint64, value uint32, seq uint64) {
+		if value != 0 && rkv.slotPos(value) >= size && !rkv.mi.closed {
+			return // the slot was lost in a crash
+		}
+		rkv.hb.Set(key, value)
+	}, onCommit: func(seq uint64) {
+		if rkv.mi.lastBatchSeq < seq {
+			rkv.mi.lastBatchSeq = seq
+		}
+	}}
+	for i, id := range ilog.fileIDList {
+		name := fmt.Sprintf("%d", id)
+		file := filepath.Join(IndexDirName, name)
+		f, err := os.Open(filepath.Join(ilog.dirName, name))
+		if err != nil {
+			report.add(file, -1, "%v", err)
+			return false
+		}
+		lenient := !rkv.mi.closed && i == len(ilog.fileIDList)-1
+		var feedErr error
+		validSize, err := scanLogsInFile(f, true, func(off int64, e logEntry) error {
+			feedErr = r.feed(off, e)
+			return feedErr
+		})
+		fileSize, sizeErr := getFileSize(f)
+		f.Close()
+		switch {
+		case feedErr != nil:
+			report.add(file, validSize, "%v", feedErr)
+			return false
+		case err != nil:
+			report.add(file, validSize, "%v", err)
+			return false
+		case sizeErr != nil:
+			report.add(file, -1, "%v", sizeErr)
+			return false
+		case lenient:
+			return true // the incomplete tail is left by a crash
+		case validSize+EntryLengthInLog > fileSize && validSize < fileSize:
+			report.add(file, validSize, "%v: incomplete entry", ErrCorruptIndexLog)
+			return false
+		case validSize < fileSize:
+			report.add(file, validSize, "%v: checksum error", ErrCorruptIndexLog)
+			return false
+		case r.inBatch:
+			report.add(file, r.beginOff, "%v: batch %d is not committed", ErrCorruptIndexLog, r.seq)
+			return false
+		}
+	}
+	return true
+}
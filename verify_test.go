@@ -0,0 +1,84 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Flip the byte at 'off' of a file
+func flipByte(t *testing.T, fname string, off int64) {
+	bz, err := ioutil.ReadFile(fname)
+	require.NoError(t, err)
+	bz[off] ^= 0xFF
+	require.NoError(t, ioutil.WriteFile(fname, bz, 0600))
+}
+
+func verify(t *testing.T, dir string) *VerifyReport {
+	report, err := Verify(dir, nil)
+	require.NoError(t, err)
+	return report
+}
+
+func TestVerify(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	rkv, err := CreateRabbitKV(dir, &Options{BlockSize: 4096, GCInterval: -1})
+	require.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		require.NoError(t, rkv.Set([]byte(fmt.Sprintf("k%d", i%100)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(t, rkv.GabageCollect(4096, 1000))
+	stats, err := rkv.Stats()
+	require.NoError(t, err)
+	pos := rkv.slotPos(rkv.hb.lookup(rkv.keyHash([]byte("k5"))))
+	file, off := rkv.hpfileLocation(pos)
+	require.NoError(t, rkv.Close())
+
+	report := verify(t, dir)
+	assert.True(t, report.OK(), "%v", report.Problems)
+	assert.Equal(t, 100, report.EntryCount)
+	assert.Equal(t, stats.ActiveBytes, report.ActiveByteCount)
+
+	// a corrupt slot is skipped, and its KV32 entry points at nothing
+	flipByte(t, filepath.Join(dir, file), off+16)
+	report = verify(t, dir)
+	require.Equal(t, 3, len(report.Problems))
+	assert.Equal(t, Problem{File: file, Offset: off, Msg: report.Problems[0].Msg}, report.Problems[0])
+	assert.Contains(t, report.Problems[0].Msg, "Corrupt slot: checksum error")
+	assert.Contains(t, report.Problems[1].String(), fmt.Sprintf("%s at %d: KV32 entry of key", file, off))
+	assert.Equal(t, MetaFileName, report.Problems[2].File)
+	flipByte(t, filepath.Join(dir, file), off+16)
+
+	metaFile := filepath.Join(dir, MetaFileName)
+	flipByte(t, metaFile, MetaInfoBytes-1)
+	report = verify(t, dir)
+	assert.Equal(t, []Problem{{MetaFileName, MetaInfoBytes - 4, "Corrupt meta file: checksum error"}}, report.Problems)
+	flipByte(t, metaFile, MetaInfoBytes-1)
+
+	logFile := filepath.Join(IndexDirName, "0")
+	bz, err := ioutil.ReadFile(filepath.Join(dir, logFile))
+	require.NoError(t, err)
+	appendToFile(t, filepath.Join(dir, logFile), []byte{1, 2, 3})
+	report = verify(t, dir)
+	assert.Equal(t, []Problem{{logFile, int64(len(bz)), "Corrupt index log: incomplete entry"}}, report.Problems)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, logFile), bz, 0600))
+
+	// the incomplete tail left by a crash is not a problem
+	rkv, err = Open(dir, &Options{GCInterval: -1})
+	require.NoError(t, err)
+	require.NoError(t, rkv.Set([]byte("k1"), []byte("new")))
+	file, _ = rkv.hpfileLocation(rkv.hpfile.Size())
+	crash(rkv)
+	appendToFile(t, filepath.Join(dir, file), []byte{100, 0, 0, 0, 1})
+	appendToFile(t, filepath.Join(dir, logFile), []byte{1, 2, 3})
+	report = verify(t, dir)
+	assert.True(t, report.OK(), "%v", report.Problems)
+	assert.Equal(t, 100, report.EntryCount)
+}
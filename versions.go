@@ -0,0 +1,142 @@
+package rabbitkv
+
+// An undo record tells that the KV32 entry of 'key40' was 'prev' before 'version' was committed
+type undoRecord struct {
+	version uint64
+	key40   uint64
+	prev    uint32
+}
+
+// The undo records of the recent versions, which are kept in memory and rebuilt by replaying
+// the index log when opened. The state as of version v is restored by undoing the records
+// whose versions are larger than v
+type versionHistory struct {
+	oldest  uint64       // the oldest version which can be read
+	records []undoRecord // in the order of versions
+	byKey   map[uint64][]undoRecord
+}
+
+func newVersionHistory(oldest uint64) *versionHistory {
+	return &versionHistory{
+		oldest: oldest,
+		byKey:  make(map[uint64][]undoRecord),
+	}
+}
+
+func (vh *versionHistory) add(version uint64, key64 uint64, prev uint32) {
+	rec := undoRecord{version: version, key40: packKey64(key64), prev: prev}
+	vh.records = append(vh.records, rec)
+	vh.byKey[rec.key40] = append(vh.byKey[rec.key40], rec)
+}
+
+// Drop the records which are not needed to read 'oldest' and the later versions
+func (vh *versionHistory) trim(oldest uint64) {
+	if oldest <= vh.oldest {
+		return
+	}
+	vh.oldest = oldest
+	n := 0
+	for ; n < len(vh.records) && vh.records[n].version <= oldest; n++ {
+		key40 := vh.records[n].key40
+		if list := vh.byKey[key40]; len(list) > 1 {
+			vh.byKey[key40] = list[1:]
+		} else {
+			delete(vh.byKey, key40)
+		}
+	}
+	vh.records = vh.records[n:] // the underlying array is released when append reallocates
+}
+
+// Return the KV32 value of key64 as of 'version', given its latest value
+func (vh *versionHistory) valueAt(key64 uint64, version uint64, latest uint32) uint32 {
+	list := vh.byKey[packKey64(key64)]
+	for i := len(list) - 1; i >= 0 && list[i].version > version; i-- {
+		latest = list[i].prev
+	}
+	return latest
+}
+
+// Return the smallest position of the slots referred by the records, or 'limit' if it is smaller.
+// 'head' is the head of HPFile, after which the positions are decoded
+func (vh *versionHistory) minPos(limit int64, head int64) int64 {
+	for _, rec := range vh.records {
+		if pos := positionAfter(head, rec.prev); rec.prev != 0 && pos < limit {
+			limit = pos
+		}
+	}
+	return limit
+}
+
+// The oldest version which should be kept readable according to Options.KeepVersions
+func (rkv *RabbitKV) retainedVersion() uint64 {
+	if rkv.mi.lastBatchSeq < rkv.opts.KeepVersions {
+		return 0
+	}
+	return rkv.mi.lastBatchSeq - rkv.opts.KeepVersions + 1
+}
+
+// Return the value of 'key' as of 'version', i.e., after the batch with this sequence number
+// was committed. Only the versions in the retention window of Options.KeepVersions can be read,
+// and after reopening, only the ones committed after all the Hash3 shards are dumped in the
+// retained index-log files
+func (rkv *RabbitKV) GetAtVersion(key []byte, version uint64) ([]byte, error) {
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	if rkv.isClosed {
+		return nil, ErrClosed
+	}
+	if rkv.history == nil {
+		return nil, ErrNotVersioned
+	}
+	if version < rkv.history.oldest || version > rkv.mi.lastBatchSeq {
+		return nil, ErrVersionUnavailable
+	}
+	key64 := rkv.keyHash(key)
+	value32 := rkv.history.valueAt(key64, version, rkv.hb.lookup(key64))
+	if value32 == 0 {
+		return nil, nil
+	}
+	slot, _, err := rkv.ReadSlot(rkv.slotPos(value32))
+	if err != nil {
+		return nil, err
+	}
+	if value := slot.Get(key); value != nil {
+		return append([]byte{}, value...), nil
+	}
+	return nil, nil
+}
+
+// The latest committed version, i.e., the sequence number of the last batch
+func (rkv *RabbitKV) LatestVersion() uint64 {
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	return rkv.mi.lastBatchSeq
+}
+
+// The oldest version which can be read by GetAtVersion
+func (rkv *RabbitKV) OldestVersion() (uint64, error) {
+	rkv.mtx.RLock()
+	defer rkv.mtx.RUnlock()
+	if rkv.history == nil {
+		return 0, ErrNotVersioned
+	}
+	return rkv.history.oldest, nil
+}
+
+// After replaying, the versions out of the retention window are dropped, and so are the
+// versions before 'completeSeq', when some Hash3 shards were not complete yet, and the
+// versions whose undo records refer to the pruned blocks
+func (rkv *RabbitKV) trimHistoryAfterLoad(completeSeq uint64) {
+	oldest := rkv.retainedVersion()
+	if oldest < completeSeq {
+		oldest = completeSeq
+	}
+	size := rkv.hpfile.Size()
+	for _, rec := range rkv.history.records {
+		// a position in the pruned blocks is decoded after the end of HPFile
+		if rec.prev != 0 && rkv.slotPos(rec.prev) >= size && oldest < rec.version {
+			oldest = rec.version
+		}
+	}
+	rkv.history.trim(oldest)
+}
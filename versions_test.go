@@ -0,0 +1,123 @@
+package rabbitkv
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getAtVersion(t *testing.T, rkv *RabbitKV, key string, version uint64) string {
+	v, err := rkv.GetAtVersion([]byte(key), version)
+	require.NoError(t, err)
+	return string(v)
+}
+
+// In version i, key0..key9 are set to "i" except that key<i%10> is deleted
+func commitVersions(t *testing.T, rkv *RabbitKV, from, to int) {
+	for i := from; i <= to; i++ {
+		batch := rkv.NewBatch()
+		for k := 0; k < 10; k++ {
+			if k == i%10 {
+				batch.Delete([]byte(fmt.Sprintf("key%d", k)))
+			} else {
+				require.NoError(t, batch.Set([]byte(fmt.Sprintf("key%d", k)), []byte(fmt.Sprint(i))))
+			}
+		}
+		require.NoError(t, batch.Close())
+	}
+}
+
+func checkVersions(t *testing.T, rkv *RabbitKV, from, to int) {
+	for i := from; i <= to; i++ {
+		for k := 0; k < 10; k++ {
+			expected := fmt.Sprint(i)
+			if k == i%10 {
+				expected = ""
+			}
+			assert.Equal(t, expected, getAtVersion(t, rkv, fmt.Sprintf("key%d", k), uint64(i)))
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 4096, GCInterval: -1, KeepVersions: 50}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "", getAtVersion(t, rkv, "key0", 0))
+	require.NoError(t, rkv.Set([]byte("single"), []byte("x")))
+	assert.Equal(t, uint64(1), rkv.LatestVersion())
+	assert.Equal(t, "", getAtVersion(t, rkv, "single", 0))
+	assert.Equal(t, "x", getAtVersion(t, rkv, "single", 1))
+
+	commitVersions(t, rkv, 2, 40)
+	checkVersions(t, rkv, 2, 40)
+	_, err = rkv.GetAtVersion([]byte("key1"), 41)
+	assert.Equal(t, ErrVersionUnavailable, err)
+
+	commitVersions(t, rkv, 41, 100)
+	oldest, err := rkv.OldestVersion()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(51), oldest)
+	_, err = rkv.GetAtVersion([]byte("key1"), 50)
+	assert.Equal(t, ErrVersionUnavailable, err)
+
+	// garbage collection does not prune the slots of the retained versions
+	require.NoError(t, rkv.GabageCollect(1<<30, 1<<30))
+	require.NoError(t, rkv.GabageCollect(1<<30, 1<<30))
+	assert.True(t, rkv.hpfile.StartPos() > 0)
+	checkVersions(t, rkv, 51, 100)
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	oldest, err = rkv.OldestVersion()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(51), oldest)
+	checkVersions(t, rkv, 51, 100)
+	commitVersions(t, rkv, 101, 110)
+	crash(rkv)
+
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	checkVersions(t, rkv, 61, 110)
+	require.NoError(t, rkv.Close())
+
+	rkv, err = Open(dir, &Options{})
+	require.NoError(t, err)
+	_, err = rkv.GetAtVersion([]byte("key1"), 100)
+	assert.Equal(t, ErrNotVersioned, err)
+	require.NoError(t, rkv.Close())
+}
+
+func TestVersionsWithRotatedLogs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	opts := &Options{BlockSize: 1 << 20, GCInterval: -1, KeepVersions: 1 << 20, IndexRotateRatio: 1,
+		RetainedLogFiles: 257, Sync: SyncNone}
+	rkv, err := CreateRabbitKV(dir, opts)
+	require.NoError(t, err)
+	latest := 0
+	for rkv.ilog.fileIDList[0] == 0 {
+		commitVersions(t, rkv, latest+1, latest+100)
+		latest += 100
+	}
+	require.NoError(t, rkv.Close())
+
+	// the versions before all the Hash3 shards are dumped in the retained files are unavailable
+	rkv, err = Open(dir, opts)
+	require.NoError(t, err)
+	oldest, err := rkv.OldestVersion()
+	require.NoError(t, err)
+	assert.True(t, oldest > 0 && oldest < uint64(latest))
+	checkVersions(t, rkv, int(oldest), latest)
+	_, err = rkv.GetAtVersion([]byte("key1"), oldest-1)
+	assert.Equal(t, ErrVersionUnavailable, err)
+	require.NoError(t, rkv.Close())
+}